@@ -1,7 +1,9 @@
 package daikin
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,59 +15,72 @@ import (
 	"github.com/yob/home-data/pubsub"
 )
 
+// how long to wait before connecting again when the unit can't be reached for control.
+// It doesn't depend on poll_interval, control requests get no reply until it's done
+const controlRetryDelay = 5 * time.Second
+
 type configData struct {
-	address string
-	name    string
-	token   string
+	Name         string        `config:"name,required"`
+	Address      string        `config:"address,required"`
+	Token        string        `config:"token"`
+	PollInterval time.Duration `config:"poll_interval" default:"20s"`
 }
 
-func Init(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader, configSection *conf.ConfigSection) {
+// ConfigSchema lists the keys Init reads from its config section
+var ConfigSchema = conf.SchemaFor(configData{})
+
+func Init(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader, configSection *conf.ConfigSection) {
 	var wg sync.WaitGroup
 
-	config, err := newConfigFromSection(configSection)
-	if err != nil {
+	var config configData
+	if err := configSection.Decode(&config); err != nil {
 		logger.Fatal(fmt.Sprintf("daikin: %v", err))
 		return
 	}
 
 	wg.Add(1)
 	go func() {
-		broadcastState(bus, logger, config)
+		broadcastState(ctx, bus, logger, config)
 		wg.Done()
 	}()
 
 	wg.Add(1)
 	go func() {
-		changeState(bus, logger, config)
+		changeState(ctx, bus, logger, config)
 		wg.Done()
 	}()
 
 	wg.Wait()
 }
 
-func broadcastState(bus *pubsub.Pubsub, logger *logging.Logger, config configData) {
-	insideTempSensor := entities.NewSensorGauge(bus, fmt.Sprintf("daikin.%s.temp_inside_celcius", config.name))
-	outsideTempSensor := entities.NewSensorGauge(bus, fmt.Sprintf("daikin.%s.temp_outside_celcius", config.name))
-	powerSensor := entities.NewSensorBoolean(bus, fmt.Sprintf("daikin.%s.power", config.name))
-	wattHoursTodaySensor := entities.NewSensorGauge(bus, fmt.Sprintf("daikin.%s.watt_hours_today", config.name))
+func broadcastState(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, config configData) {
+	insideTempSensor := entities.NewSensorGauge(bus, fmt.Sprintf("daikin.%s.temp_inside_celcius", config.Name), entities.WithUnit("celsius"), entities.WithDeviceClass("temperature"))
+	outsideTempSensor := entities.NewSensorGauge(bus, fmt.Sprintf("daikin.%s.temp_outside_celcius", config.Name), entities.WithUnit("celsius"), entities.WithDeviceClass("temperature"))
+	powerSensor := entities.NewSensorBoolean(bus, fmt.Sprintf("daikin.%s.power", config.Name), entities.WithDeviceClass("power_state"))
+	modeSensor := entities.NewSensorEnum(bus, fmt.Sprintf("daikin.%s.mode", config.Name), entities.WithDeviceClass("hvac_mode"))
+	wattHoursTodaySensor := entities.NewSensorGauge(bus, fmt.Sprintf("daikin.%s.watt_hours_today", config.Name), entities.WithUnit("Wh"), entities.WithDeviceClass("energy"))
 
 	for {
-		time.Sleep(20 * time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(config.PollInterval):
+		}
 
-		d, err := daikinClient.NewNetwork(daikinClient.AddressTokenOption(config.address, config.token))
+		d, err := daikinClient.NewNetwork(daikinClient.AddressTokenOption(config.Address, config.Token))
 		if err != nil {
-			logger.Error(fmt.Sprintf("daikin (%s): %v", config.name, err))
+			logger.Error(fmt.Sprintf("daikin (%s): %v", config.Name, err))
 			continue
 		}
 
-		dev := d.Devices[config.address]
+		dev := d.Devices[config.Address]
 		if err := dev.GetControlInfo(); err != nil {
-			logger.Error(fmt.Sprintf("daikin (%s): %v", config.name, err))
+			logger.Error(fmt.Sprintf("daikin (%s): %v", config.Name, err))
 			continue
 		}
 
 		if err := dev.GetSensorInfo(); err != nil {
-			logger.Error(fmt.Sprintf("daikin (%s): %v", config.name, err))
+			logger.Error(fmt.Sprintf("daikin (%s): %v", config.Name, err))
 			continue
 		}
 
@@ -73,14 +88,15 @@ func broadcastState(bus *pubsub.Pubsub, logger *logging.Logger, config configDat
 		outsideTempSensor.Update(float64(dev.SensorInfo.OutsideTemperature))
 
 		if err := dev.GetControlInfo(); err != nil {
-			logger.Error(fmt.Sprintf("daikin (%s): %v", config.name, err))
+			logger.Error(fmt.Sprintf("daikin (%s): %v", config.Name, err))
 			continue
 		}
 
 		powerSensor.Update(dev.ControlInfo.Power.String() == "On")
+		modeSensor.Update(strings.ToLower(dev.ControlInfo.Mode.String()))
 
 		if err := dev.GetWeekPower(); err != nil {
-			logger.Error(fmt.Sprintf("daikin (%s): %v", config.name, err))
+			logger.Error(fmt.Sprintf("daikin (%s): %v", config.Name, err))
 			continue
 		}
 
@@ -88,76 +104,68 @@ func broadcastState(bus *pubsub.Pubsub, logger *logging.Logger, config configDat
 	}
 }
 
-func changeState(bus *pubsub.Pubsub, logger *logging.Logger, config configData) {
+func changeState(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, config configData) {
+	// connect straight away the first time
+	var delay time.Duration
 	for {
-		time.Sleep(20 * time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = controlRetryDelay
 
-		d, err := daikinClient.NewNetwork(daikinClient.AddressTokenOption(config.address, config.token))
+		d, err := daikinClient.NewNetwork(daikinClient.AddressTokenOption(config.Address, config.Token))
 		if err != nil {
-			logger.Error(fmt.Sprintf("daikin (%s): %v", config.name, err))
+			logger.Error(fmt.Sprintf("daikin (%s): %v", config.Name, err))
 			continue
 		}
 
-		dev := d.Devices[config.address]
+		dev := d.Devices[config.Address]
 		if err := dev.GetControlInfo(); err != nil {
-			logger.Error(fmt.Sprintf("daikin (%s): %v", config.name, err))
+			logger.Error(fmt.Sprintf("daikin (%s): %v", config.Name, err))
 			continue
 		}
 
-		subControl, _ := bus.Subscribe(fmt.Sprintf("daikin.%s.control", config.name))
-		defer subControl.Close()
+		// the subscription is only closed when ctx is cancelled or the bus is shutdown
+		subControl, _ := bus.Subscribe(ctx, fmt.Sprintf("daikin.%s.control", config.Name))
 
 		for event := range subControl.Ch {
 			if event.Key == "power" && event.Value == "off" {
 				if err := dev.GetControlInfo(); err != nil {
-					logger.Error(fmt.Sprintf("daikin (%s): %v", config.name, err))
+					logger.Error(fmt.Sprintf("daikin (%s): %v", config.Name, err))
+					bus.Reply(event, pubsub.NewReplyEvent(err))
 					continue
 				}
 
 				dev.ControlInfo.Power = daikinClient.PowerOff
 				if err := dev.SetControlInfo(); err != nil {
-					logger.Error(fmt.Sprintf("daikin (%s): error setting control: %v", config.name, err))
+					logger.Error(fmt.Sprintf("daikin (%s): error setting control: %v", config.Name, err))
+					bus.Reply(event, pubsub.NewReplyEvent(err))
 					continue
 				}
-				logger.Debug(fmt.Sprintf("daikin (%s): power changed to off", config.name))
+				logger.Debug(fmt.Sprintf("daikin (%s): power changed to off", config.Name))
+				bus.Reply(event, pubsub.NewReplyEvent(nil))
 			} else if event.Key == "power" && event.Value == "on" {
 				if err := dev.GetControlInfo(); err != nil {
-					logger.Error(fmt.Sprintf("daikin (%s): %v", config.name, err))
+					logger.Error(fmt.Sprintf("daikin (%s): %v", config.Name, err))
+					bus.Reply(event, pubsub.NewReplyEvent(err))
 					continue
 				}
 
 				dev.ControlInfo.Power = daikinClient.PowerOn
 				if err := dev.SetControlInfo(); err != nil {
-					logger.Error(fmt.Sprintf("daikin (%s): error setting control: %v", config.name, err))
+					logger.Error(fmt.Sprintf("daikin (%s): error setting control: %v", config.Name, err))
+					bus.Reply(event, pubsub.NewReplyEvent(err))
 					continue
 				}
-				logger.Debug(fmt.Sprintf("daikin (%s): power changed to on", config.name))
+				logger.Debug(fmt.Sprintf("daikin (%s): power changed to on", config.Name))
+				bus.Reply(event, pubsub.NewReplyEvent(nil))
 			} else {
-				logger.Error(fmt.Sprintf("daikin (%s): unrecognised event: %v", config.name, event))
+				logger.Error(fmt.Sprintf("daikin (%s): unrecognised event: %v", config.Name, event))
+				bus.Reply(event, pubsub.NewReplyEvent(fmt.Errorf("daikin (%s): unrecognised event", config.Name)))
 			}
 		}
+		subControl.Close()
 	}
 }
-
-func newConfigFromSection(configSection *conf.ConfigSection) (configData, error) {
-	name, err := configSection.GetString("name")
-	if err != nil {
-		return configData{}, fmt.Errorf("name not found in config")
-	}
-
-	address, err := configSection.GetString("address")
-	if err != nil {
-		return configData{}, fmt.Errorf("address not found in config for %s", name)
-	}
-
-	token, err := configSection.GetString("token")
-	if err != nil {
-		token = ""
-	}
-
-	return configData{
-		address: address,
-		name:    name,
-		token:   token,
-	}, nil
-}
@@ -3,6 +3,7 @@ package datadog
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	conf "github.com/yob/home-data/core/config"
@@ -13,43 +14,104 @@ import (
 	datadog "github.com/DataDog/datadog-api-client-go/api/v1/datadog"
 )
 
-func Init(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader, config *conf.ConfigSection) {
-	apiKey, err := config.GetString("api_key")
-	if err != nil {
-		logger.Fatal("datadog: api_key not found in config")
-		return
-	}
-	appKey, err := config.GetString("app_key")
-	if err != nil {
-		logger.Fatal("datadog: app_key not found in config")
-		return
-	}
+type configData struct {
+	APIKey string   `config:"api_key,required"`
+	AppKey string   `config:"app_key,required"`
+	Keys   []string `config:"keys,required"`
+}
 
-	interestingKeys, err := config.GetStringSlice("keys")
-	if err != nil {
-		logger.Fatal("datadog: keys not found in config")
+// ConfigSchema lists the keys Init reads from its config section
+var ConfigSchema = conf.SchemaFor(configData{})
+
+func Init(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader, configSection *conf.ConfigSection) {
+	var config configData
+	if err := configSection.Decode(&config); err != nil {
+		logger.Fatal(fmt.Sprintf("datadog: %v", err))
 		return
 	}
 
-	sub, _ := bus.Subscribe("every:minute")
+	sub, _ := bus.Subscribe(ctx, "every:minute")
 	defer sub.Close()
 
 	for _ = range sub.Ch {
-		processEvent(logger, apiKey, appKey, state, interestingKeys)
+		processEvent(logger, config.APIKey, config.AppKey, state, config.Keys)
 	}
 }
 
 func processEvent(logger *logging.Logger, apiKey string, appKey string, state homestate.StateReader, interestingKeys []string) {
-	for _, stateKey := range interestingKeys {
-		if value, ok := state.ReadFloat64(stateKey); ok {
-			ddSubmitGauge(logger, apiKey, appKey, stateKey, value)
-		} else {
+	for _, stateKey := range expandKeys(logger, state, interestingKeys) {
+		value, ok := state.ReadValue(stateKey)
+		if !ok {
 			logger.Debug(fmt.Sprintf("datadog: failed to read %s from state", stateKey))
+			continue
+		}
+		gauge, ok := gaugeValue(value)
+		if !ok {
+			logger.Debug(fmt.Sprintf("datadog: %s is a %s, only numbers and bools can be sent", stateKey, value.Kind()))
+			continue
 		}
+		metadata, _ := state.ReadMetadata(stateKey)
+		ddSubmitGauge(logger, apiKey, appKey, stateKey, gauge, metadataTags(metadata))
+	}
+}
+
+// datadog only understands numbers, so bools are sent as 1 or 0
+func gaugeValue(value homestate.Value) (float64, bool) {
+	if number, ok := value.Numeric(); ok {
+		return number, true
+	}
+	if boolean, err := value.Bool(); err == nil {
+		if boolean {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// keys in the config can be patterns like "ruuvi.#", so new sensors are sent to datadog
+// without a config change. Patterns that match nothing right now are skipped quietly, the
+// sensors might not have reported yet
+func expandKeys(logger *logging.Logger, state homestate.StateReader, interestingKeys []string) []string {
+	result := make([]string, 0, len(interestingKeys))
+	seen := make(map[string]bool)
+	for _, stateKey := range interestingKeys {
+		keys := []string{stateKey}
+		if strings.ContainsAny(stateKey, "*#") {
+			var err error
+			keys, err = state.Keys(stateKey)
+			if err != nil {
+				logger.Error(fmt.Sprintf("datadog: unable to find the keys matching %s - %v", stateKey, err))
+				continue
+			}
+		}
+		for _, key := range keys {
+			if !seen[key] {
+				seen[key] = true
+				result = append(result, key)
+			}
+		}
+	}
+	return result
+}
+
+// tag each metric with what we know about it, so it's possible to filter and group
+// in datadog. Anything that isn't known is left off
+func metadataTags(metadata homestate.Metadata) []string {
+	tags := make([]string, 0, 3)
+	if metadata.Unit != "" {
+		tags = append(tags, fmt.Sprintf("unit:%s", metadata.Unit))
+	}
+	if metadata.DeviceClass != "" {
+		tags = append(tags, fmt.Sprintf("device_class:%s", metadata.DeviceClass))
+	}
+	if metadata.Source != "" {
+		tags = append(tags, fmt.Sprintf("source:%s", metadata.Source))
 	}
+	return tags
 }
 
-func ddSubmitGauge(logger *logging.Logger, apiKey string, appKey string, property string, value float64) {
+func ddSubmitGauge(logger *logging.Logger, apiKey string, appKey string, property string, value float64, tags []string) {
 	ctx := context.WithValue(
 		context.Background(),
 		datadog.ContextAPIKeys,
@@ -64,7 +126,9 @@ func ddSubmitGauge(logger *logging.Logger, apiKey string, appKey string, propert
 	)
 
 	nowEpoch := float64(time.Now().Unix())
-	body := *datadog.NewMetricsPayload([]datadog.Series{*datadog.NewSeries(property, [][]*float64{[]*float64{&nowEpoch, &value}})})
+	series := datadog.NewSeries(property, [][]*float64{[]*float64{&nowEpoch, &value}})
+	series.SetTags(tags)
+	body := *datadog.NewMetricsPayload([]datadog.Series{*series})
 	configuration := datadog.NewConfiguration()
 
 	apiClient := datadog.NewAPIClient(configuration)
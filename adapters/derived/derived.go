@@ -0,0 +1,217 @@
+package derived
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	conf "github.com/yob/home-data/core/config"
+	"github.com/yob/home-data/core/entities"
+	"github.com/yob/home-data/core/homestate"
+	"github.com/yob/home-data/core/logging"
+	"github.com/yob/home-data/pubsub"
+)
+
+// the sensor for a derived key, either a gauge or a boolean depending on the expression
+type sensor interface {
+	Unset()
+}
+
+type derivedKey struct {
+	name       string
+	expression string
+	root       node
+	inputs     []string
+	sensor     sensor
+}
+
+// each map is keyed by the name of the derived key
+type configData struct {
+	Keys          map[string]string `config:"keys,required"`
+	Units         map[string]string `config:"units"`
+	DeviceClasses map[string]string `config:"device_classes"`
+}
+
+// ConfigSchema lists the keys Init reads from its config section
+var ConfigSchema = conf.SchemaFor(configData{})
+
+// Computes new state keys from existing ones, using expressions from the config:
+//
+//	[derived]
+//	adapter = "derived"
+//
+//	[derived.keys]
+//	solar_surplus_watts = "max(0, -fronius.inverter.grid_draw_watts)"
+//	kitchen_outside_delta_celcius = "ruuvi.kitchen.temp_celcius - ruuvi.outside.temp_celcius"
+//
+//	[derived.units]
+//	solar_surplus_watts = "W"
+//
+// See parse for what expressions can contain. Keys are recomputed whenever one of their
+// inputs changes, and removed while any input they need is missing. Derived keys can be
+// used as inputs to other derived keys, as long as there's no cycle.
+func Init(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader, configSection *conf.ConfigSection) {
+	var config configData
+	if err := configSection.Decode(&config); err != nil {
+		logger.Fatal(fmt.Sprintf("derived: %v", err))
+		return
+	}
+
+	keys, err := newKeys(bus, config)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("derived: %v", err))
+		return
+	}
+
+	dependents := make(map[string][]*derivedKey)
+	for _, key := range keys {
+		for _, input := range key.inputs {
+			dependents[input] = append(dependents[input], key)
+		}
+	}
+
+	// subscribe before the first calculation, so no changes are missed in between
+	sub, err := pubsub.Subscribe[homestate.Change](ctx, bus, "state:changed", pubsub.WithDropPolicy(pubsub.CoalesceByKey))
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("derived: unable to subscribe to state changes - %v", err))
+		return
+	}
+	defer sub.Close()
+
+	for _, key := range keys {
+		recompute(logger, state, key)
+	}
+
+	for event := range sub.Ch {
+		for _, key := range dependents[event.Payload.Key] {
+			recompute(logger, state, key)
+		}
+	}
+}
+
+func recompute(logger *logging.Logger, state homestate.StateReader, key *derivedKey) {
+	value, err := key.root.eval(func(input string) (float64, error) {
+		return readInput(state, input)
+	})
+	if err != nil {
+		if errors.Is(err, errMissingInput) {
+			logger.Debug(fmt.Sprintf("derived: unable to compute %s - %v", key.name, err))
+		} else {
+			logger.Error(fmt.Sprintf("derived: unable to compute %s (%s) - %v", key.name, key.expression, err))
+		}
+		// a stale value is worse than no value, something might act on it
+		if _, ok := state.ReadValue(key.name); ok {
+			key.sensor.Unset()
+		}
+		return
+	}
+
+	switch sensor := key.sensor.(type) {
+	case *entities.SensorBoolean:
+		sensor.Update(value != 0)
+	case *entities.SensorGauge:
+		sensor.Update(value)
+	}
+}
+
+func readInput(state homestate.StateReader, key string) (float64, error) {
+	value, ok := state.ReadValue(key)
+	if !ok {
+		return 0, fmt.Errorf("%w %s", errMissingInput, key)
+	}
+	if number, ok := value.Numeric(); ok {
+		return number, nil
+	}
+	if boolean, err := value.Bool(); err == nil {
+		return fromBool(boolean), nil
+	}
+	return 0, fmt.Errorf("%s is a %s, only numbers and bools can be used", key, value.Kind())
+}
+
+func newKeys(bus *pubsub.Pubsub, config configData) ([]*derivedKey, error) {
+	keys := make([]*derivedKey, 0, len(config.Keys))
+	for name, expression := range config.Keys {
+		root, err := parse(expression)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression for %s (%s) - %v", name, expression, err)
+		}
+
+		opts := make([]entities.Option, 0)
+		if unit, ok := config.Units[name]; ok {
+			opts = append(opts, entities.WithUnit(unit))
+		}
+		if deviceClass, ok := config.DeviceClasses[name]; ok {
+			opts = append(opts, entities.WithDeviceClass(deviceClass))
+		}
+
+		var keySensor sensor
+		if root.boolean() {
+			keySensor = entities.NewSensorBoolean(bus, name, opts...)
+		} else {
+			keySensor = entities.NewSensorGauge(bus, name, opts...)
+		}
+
+		keys = append(keys, &derivedKey{
+			name:       name,
+			expression: expression,
+			root:       root,
+			inputs:     inputs(root),
+			sensor:     keySensor,
+		})
+	}
+	// map order is random, and the first calculation is easier to follow in the logs if
+	// it's always in the same order
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].name < keys[j].name
+	})
+
+	if err := checkCycles(keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// a derived key that depends on itself, directly or via other derived keys, would be
+// recomputed forever
+func checkCycles(keys []*derivedKey) error {
+	byName := make(map[string]*derivedKey)
+	for _, key := range keys {
+		byName[key.name] = key
+	}
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+	status := make(map[string]int)
+
+	var visit func(key *derivedKey, path []string) error
+	visit = func(key *derivedKey, path []string) error {
+		path = append(path, key.name)
+		switch status[key.name] {
+		case visiting:
+			return fmt.Errorf("derived keys depend on each other: %s", strings.Join(path, " -> "))
+		case done:
+			return nil
+		}
+		status[key.name] = visiting
+		for _, input := range key.inputs {
+			if next, ok := byName[input]; ok {
+				if err := visit(next, path); err != nil {
+					return err
+				}
+			}
+		}
+		status[key.name] = done
+		return nil
+	}
+
+	for _, key := range keys {
+		if err := visit(key, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,478 @@
+package derived
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// errMissingInput is returned when an expression needs a key that isn't in state
+var errMissingInput = errors.New("missing input")
+
+// lookup returns the numeric value of a state key. Bools are 1 for true and 0 for false
+type lookup func(key string) (float64, error)
+
+// A parsed expression. Everything is evaluated as a float64, comparisons and logic
+// return 1 for true and 0 for false.
+type node interface {
+	eval(lookup) (float64, error)
+
+	// true if the result is a bool rather than a number
+	boolean() bool
+}
+
+type number float64
+
+func (n number) eval(lookup) (float64, error) { return float64(n), nil }
+func (n number) boolean() bool                { return false }
+
+type boolLiteral bool
+
+func (b boolLiteral) eval(lookup) (float64, error) { return fromBool(bool(b)), nil }
+func (b boolLiteral) boolean() bool                { return true }
+
+type stateKey string
+
+func (k stateKey) eval(get lookup) (float64, error) { return get(string(k)) }
+func (k stateKey) boolean() bool                    { return false }
+
+type unary struct {
+	op      string
+	operand node
+}
+
+func (u unary) eval(get lookup) (float64, error) {
+	value, err := u.operand.eval(get)
+	if err != nil {
+		return 0, err
+	}
+	if u.op == "!" {
+		return fromBool(value == 0), nil
+	}
+	return -value, nil
+}
+
+func (u unary) boolean() bool {
+	return u.op == "!"
+}
+
+type binary struct {
+	op          string
+	left, right node
+}
+
+func (b binary) eval(get lookup) (float64, error) {
+	left, err := b.left.eval(get)
+	if err != nil {
+		return 0, err
+	}
+	// && and || only look at the right side when they need to, so an expression can guard
+	// against a key that might be missing
+	switch {
+	case b.op == "&&" && left == 0:
+		return 0, nil
+	case b.op == "||" && left != 0:
+		return 1, nil
+	}
+	right, err := b.right.eval(get)
+	if err != nil {
+		return 0, err
+	}
+
+	switch b.op {
+	case "+":
+		return left + right, nil
+	case "-":
+		return left - right, nil
+	case "*":
+		return left * right, nil
+	case "/":
+		if right == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return left / right, nil
+	case "<":
+		return fromBool(left < right), nil
+	case "<=":
+		return fromBool(left <= right), nil
+	case ">":
+		return fromBool(left > right), nil
+	case ">=":
+		return fromBool(left >= right), nil
+	case "==":
+		return fromBool(left == right), nil
+	case "!=":
+		return fromBool(left != right), nil
+	case "&&", "||":
+		return fromBool(right != 0), nil
+	default:
+		return 0, fmt.Errorf("unknown operator '%s'", b.op)
+	}
+}
+
+func (b binary) boolean() bool {
+	switch b.op {
+	case "+", "-", "*", "/":
+		return false
+	default:
+		return true
+	}
+}
+
+type call struct {
+	name string
+	args []node
+}
+
+func (c call) eval(get lookup) (float64, error) {
+	// only the branch that's chosen is evaluated, like &&
+	if c.name == "if" {
+		cond, err := c.args[0].eval(get)
+		if err != nil {
+			return 0, err
+		}
+		if cond != 0 {
+			return c.args[1].eval(get)
+		}
+		return c.args[2].eval(get)
+	}
+
+	values := make([]float64, len(c.args))
+	for i, arg := range c.args {
+		value, err := arg.eval(get)
+		if err != nil {
+			return 0, err
+		}
+		values[i] = value
+	}
+
+	switch c.name {
+	case "abs":
+		return math.Abs(values[0]), nil
+	case "min":
+		result := values[0]
+		for _, value := range values[1:] {
+			result = math.Min(result, value)
+		}
+		return result, nil
+	case "max":
+		result := values[0]
+		for _, value := range values[1:] {
+			result = math.Max(result, value)
+		}
+		return result, nil
+	default:
+		return 0, fmt.Errorf("unknown function '%s'", c.name)
+	}
+}
+
+func (c call) boolean() bool {
+	return c.name == "if" && c.args[1].boolean() && c.args[2].boolean()
+}
+
+// how many arguments each function takes. -1 is one or more
+var functions = map[string]int{
+	"if":  3,
+	"abs": 1,
+	"min": -1,
+	"max": -1,
+}
+
+func fromBool(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// inputs returns every state key the expression reads
+func inputs(n node) []string {
+	switch n := n.(type) {
+	case stateKey:
+		return []string{string(n)}
+	case unary:
+		return inputs(n.operand)
+	case binary:
+		return append(inputs(n.left), inputs(n.right)...)
+	case call:
+		result := make([]string, 0)
+		for _, arg := range n.args {
+			result = append(result, inputs(arg)...)
+		}
+		return result
+	default:
+		return nil
+	}
+}
+
+// parse turns an expression like "ruuvi.kitchen.temp_celcius - ruuvi.outside.temp_celcius"
+// into something that can be evaluated. State keys are written as-is, or in backticks if
+// they contain anything other than letters, numbers, "_" and "." (like `kasa.low-prices.on`).
+//
+// From lowest to highest precedence the operators are ||, &&, comparisons (< <= > >= == !=),
+// + and -, * and /, then unary - and !. The functions are if(cond, then, else), abs(x),
+// min(x, ...) and max(x, ...).
+func parse(expression string) (node, error) {
+	tokens, err := tokenize(expression)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	result, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected '%s'", p.tokens[p.pos].text)
+	}
+	return result, nil
+}
+
+type tokenKind int
+
+const (
+	tokenNumber tokenKind = iota
+	tokenIdent
+	tokenKey // a backtick quoted state key
+	tokenOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// longest first, so "<=" isn't read as "<" then "="
+var operators = []string{"&&", "||", "<=", ">=", "==", "!=", "<", ">", "+", "-", "*", "/", "!", "(", ")", ","}
+
+func tokenize(expression string) ([]token, error) {
+	tokens := make([]token, 0)
+	rest := expression
+	for {
+		rest = strings.TrimLeftFunc(rest, unicode.IsSpace)
+		if rest == "" {
+			return tokens, nil
+		}
+
+		if rest[0] == '`' {
+			end := strings.IndexByte(rest[1:], '`')
+			if end < 1 {
+				return nil, fmt.Errorf("unterminated or empty key in '%s'", expression)
+			}
+			tokens = append(tokens, token{kind: tokenKey, text: rest[1 : end+1]})
+			rest = rest[end+2:]
+			continue
+		}
+
+		// classify whole runes, a multibyte rune's bytes could look like a digit or letter
+		first, _ := utf8.DecodeRuneInString(rest)
+		if isDigit(first) {
+			end := strings.IndexFunc(rest, func(r rune) bool { return !isDigit(r) && r != '.' })
+			if end < 0 {
+				end = len(rest)
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: rest[:end]})
+			rest = rest[end:]
+			continue
+		}
+
+		if isIdentStart(first) {
+			end := strings.IndexFunc(rest, func(r rune) bool { return !isIdentStart(r) && !isDigit(r) && r != '.' })
+			if end < 0 {
+				end = len(rest)
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: rest[:end]})
+			rest = rest[end:]
+			continue
+		}
+
+		matched := false
+		for _, op := range operators {
+			if strings.HasPrefix(rest, op) {
+				tokens = append(tokens, token{kind: tokenOp, text: op})
+				rest = rest[len(op):]
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("unexpected '%c'", first)
+		}
+	}
+}
+
+func isDigit(c rune) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c rune) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// accept moves past the next token if it's one of ops
+func (p *parser) accept(ops ...string) (string, bool) {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokenOp {
+		return "", false
+	}
+	for _, op := range ops {
+		if p.tokens[p.pos].text == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) expect(op string) error {
+	if _, ok := p.accept(op); !ok {
+		if p.pos >= len(p.tokens) {
+			return fmt.Errorf("expected '%s' at the end", op)
+		}
+		return fmt.Errorf("expected '%s', found '%s'", op, p.tokens[p.pos].text)
+	}
+	return nil
+}
+
+// parses a run of left associative operators that all have the same precedence
+func (p *parser) parseBinary(next func() (node, error), ops ...string) (node, error) {
+	left, err := next()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept(ops...)
+		if !ok {
+			return left, nil
+		}
+		right, err := next()
+		if err != nil {
+			return nil, err
+		}
+		left = binary{op: op, left: left, right: right}
+	}
+}
+
+func (p *parser) parseOr() (node, error) {
+	return p.parseBinary(p.parseAnd, "||")
+}
+
+func (p *parser) parseAnd() (node, error) {
+	return p.parseBinary(p.parseComparison, "&&")
+}
+
+// comparisons don't chain, "a < b < c" is an error rather than a surprise
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseAdd()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.accept("<=", ">=", "==", "!=", "<", ">")
+	if !ok {
+		return left, nil
+	}
+	right, err := p.parseAdd()
+	if err != nil {
+		return nil, err
+	}
+	return binary{op: op, left: left, right: right}, nil
+}
+
+func (p *parser) parseAdd() (node, error) {
+	return p.parseBinary(p.parseMultiply, "+", "-")
+}
+
+func (p *parser) parseMultiply() (node, error) {
+	return p.parseBinary(p.parseUnary, "*", "/")
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if op, ok := p.accept("-", "!"); ok {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return unary{op: op, operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	tok := p.tokens[p.pos]
+	p.pos++
+
+	switch tok.kind {
+	case tokenNumber:
+		value, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s'", tok.text)
+		}
+		return number(value), nil
+	case tokenKey:
+		return stateKey(tok.text), nil
+	case tokenIdent:
+		switch tok.text {
+		case "true":
+			return boolLiteral(true), nil
+		case "false":
+			return boolLiteral(false), nil
+		}
+		if _, ok := p.accept("("); ok {
+			return p.parseCall(tok.text)
+		}
+		return stateKey(tok.text), nil
+	}
+
+	if tok.text == "(" {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	}
+	return nil, fmt.Errorf("unexpected '%s'", tok.text)
+}
+
+// the name and "(" have already been read
+func (p *parser) parseCall(name string) (node, error) {
+	arity, ok := functions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function '%s'", name)
+	}
+
+	args := make([]node, 0)
+	if _, ok := p.accept(")"); !ok {
+		for {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if _, ok := p.accept(","); !ok {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+
+	if (arity < 0 && len(args) == 0) || (arity >= 0 && len(args) != arity) {
+		return nil, fmt.Errorf("wrong number of arguments to %s()", name)
+	}
+	return call{name: name, args: args}, nil
+}
@@ -0,0 +1,228 @@
+package derived
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// state for the tests. Anything else is a missing input
+var testState = map[string]float64{
+	"one":                 1,
+	"two":                 2,
+	"zero":                0,
+	"ruuvi.kitchen.temp":  21.5,
+	"kasa.low-prices.on":  1,
+	"ruuvi.küche.celcius": 19,
+}
+
+func testLookup(key string) (float64, error) {
+	value, ok := testState[key]
+	if !ok {
+		return 0, fmt.Errorf("%w %s", errMissingInput, key)
+	}
+	return value, nil
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       float64
+	}{
+		// precedence
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"8 / 4 / 2", 1},
+		{"-2 * 3", -6},
+		{"- -2", 2},
+		{"!0 + 1", 2},
+		{"1 + 1 == 2", 1},
+		{"1 || 0 && 0", 1},
+		{"(1 || 0) && 0", 0},
+		{"two > one && one > zero", 1},
+		{"!(one > two)", 1},
+		{"1.5 * 2", 3},
+		{"true", 1},
+		{"false || true", 1},
+
+		// state keys
+		{"ruuvi.kitchen.temp - 1.5", 20},
+		{"`kasa.low-prices.on` && true", 1},
+		{"`ruuvi.küche.celcius` + 1", 20},
+
+		// functions
+		{"if(one > zero, 10, 20)", 10},
+		{"if(zero, 10, 20)", 20},
+		{"if(one, if(zero, 1, 2), 3)", 2},
+		{"abs(-3)", 3},
+		{"min(3, 1, 2)", 1},
+		{"max(3, 1, 2)", 3},
+		{"max(1)", 1},
+
+		// the side that isn't needed isn't read, so a missing key is fine
+		{"false && missing", 0},
+		{"zero && missing", 0},
+		{"true || missing", 1},
+		{"if(one, 5, missing)", 5},
+		{"if(zero, missing, 6)", 6},
+	}
+	for _, test := range tests {
+		root, err := parse(test.expression)
+		if err != nil {
+			t.Errorf("parse(%s): %v", test.expression, err)
+			continue
+		}
+		got, err := root.eval(testLookup)
+		if err != nil {
+			t.Errorf("eval(%s): %v", test.expression, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("eval(%s) = %v, want %v", test.expression, got, test.want)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		missing    bool // the error should be errMissingInput
+		want       string
+	}{
+		{"missing + 1", true, "missing input missing"},
+		{"true && missing", true, "missing input missing"},
+		{"false || missing", true, "missing input missing"},
+		{"if(missing, 1, 2)", true, "missing input missing"},
+		{"if(one, missing, 2)", true, "missing input missing"},
+		{"one / zero", false, "division by zero"},
+		{"1 / (two - 2)", false, "division by zero"},
+	}
+	for _, test := range tests {
+		root, err := parse(test.expression)
+		if err != nil {
+			t.Errorf("parse(%s): %v", test.expression, err)
+			continue
+		}
+		_, err = root.eval(testLookup)
+		if err == nil || err.Error() != test.want {
+			t.Errorf("eval(%s) error = %v, want %s", test.expression, err, test.want)
+			continue
+		}
+		if errors.Is(err, errMissingInput) != test.missing {
+			t.Errorf("eval(%s): errors.Is(err, errMissingInput) = %t, want %t", test.expression, !test.missing, test.missing)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       string
+	}{
+		// comparisons don't chain
+		{"1 < 2 < 3", "unexpected '<'"},
+		{"one == one == one", "unexpected '=='"},
+		{"1 < 2 == 1", "unexpected '=='"},
+
+		// arity
+		{"if(1, 2)", "wrong number of arguments to if()"},
+		{"if(1, 2, 3, 4)", "wrong number of arguments to if()"},
+		{"abs()", "wrong number of arguments to abs()"},
+		{"abs(1, 2)", "wrong number of arguments to abs()"},
+		{"min()", "wrong number of arguments to min()"},
+		{"max()", "wrong number of arguments to max()"},
+		{"sqrt(4)", "unknown function 'sqrt'"},
+
+		// backticks
+		{"`kasa.low-prices.on", "unterminated or empty key"},
+		{"`` + 1", "unterminated or empty key"},
+
+		// non-ASCII runes are only allowed in backticks. Their bytes mustn't be mistaken
+		// for digits (İ is U+0130) or letters (Ł is U+0141)
+		{"1İ", "unexpected 'İ'"},
+		{"ruuvi.küche.celcius", "unexpected 'ü'"},
+		{"Łodz", "unexpected 'Ł'"},
+
+		{"", "unexpected end of expression"},
+		{"1 +", "unexpected end of expression"},
+		{"(1 + 2", "expected ')' at the end"},
+		{"min(1 2)", "expected ')', found '2'"},
+		{"1 2", "unexpected '2'"},
+		{"1 = 2", "unexpected '='"},
+		{"1..2", "invalid number '1..2'"},
+	}
+	for _, test := range tests {
+		_, err := parse(test.expression)
+		if err == nil || !strings.HasPrefix(err.Error(), test.want) {
+			t.Errorf("parse(%s) error = %v, want %s", test.expression, err, test.want)
+		}
+	}
+}
+
+func TestBooleanAndInputs(t *testing.T) {
+	tests := []struct {
+		expression string
+		boolean    bool
+		inputs     []string
+	}{
+		{"one + two", false, []string{"one", "two"}},
+		{"one > two", true, []string{"one", "two"}},
+		{"!`kasa.low-prices.on`", true, []string{"kasa.low-prices.on"}},
+		{"if(one, true, zero > 1)", true, []string{"one", "zero"}},
+		{"if(one, two, false)", false, []string{"one", "two"}},
+		{"max(one, abs(two))", false, []string{"one", "two"}},
+		{"1 + 2", false, nil},
+	}
+	for _, test := range tests {
+		root, err := parse(test.expression)
+		if err != nil {
+			t.Errorf("parse(%s): %v", test.expression, err)
+			continue
+		}
+		if root.boolean() != test.boolean {
+			t.Errorf("%s: boolean() = %t, want %t", test.expression, root.boolean(), test.boolean)
+		}
+		if got := inputs(root); !reflect.DeepEqual(got, test.inputs) && (len(got) > 0 || len(test.inputs) > 0) {
+			t.Errorf("%s: inputs() = %v, want %v", test.expression, got, test.inputs)
+		}
+	}
+}
+
+func TestCheckCycles(t *testing.T) {
+	tests := []struct {
+		name string
+		keys map[string][]string // derived key to its inputs
+		want string
+	}{
+		{"independent", map[string][]string{"a": {"x"}, "b": {"y"}}, ""},
+		{"chain", map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"x"}}, ""},
+		{"shared input", map[string][]string{"a": {"c"}, "b": {"c"}, "c": {"x"}}, ""},
+		{"itself", map[string][]string{"a": {"a"}}, "derived keys depend on each other: a -> a"},
+		{"each other", map[string][]string{"a": {"b"}, "b": {"a"}}, "derived keys depend on each other: a -> b -> a"},
+		{"longer", map[string][]string{"a": {"x", "b"}, "b": {"c"}, "c": {"a"}}, "derived keys depend on each other: a -> b -> c -> a"},
+	}
+	for _, test := range tests {
+		// sorted by name, like newKeys
+		names := make([]string, 0, len(test.keys))
+		for name := range test.keys {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		keys := make([]*derivedKey, 0, len(names))
+		for _, name := range names {
+			keys = append(keys, &derivedKey{name: name, inputs: test.keys[name]})
+		}
+
+		err := checkCycles(keys)
+		switch {
+		case test.want == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		case test.want != "" && (err == nil || err.Error() != test.want):
+			t.Errorf("%s: error = %v, want %s", test.name, err, test.want)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package fronius
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"math"
 	"net/http"
@@ -15,28 +16,40 @@ import (
 	pubsub "github.com/yob/home-data/pubsub"
 )
 
-func Init(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader, config *conf.ConfigSection) {
-	address, err := config.GetString("address")
-	if err != nil {
-		logger.Fatal("fronius: address not found in config")
+type configData struct {
+	Address      string        `config:"address,required"`
+	PollInterval time.Duration `config:"poll_interval" default:"20s"`
+}
+
+// ConfigSchema lists the keys Init reads from its config section
+var ConfigSchema = conf.SchemaFor(configData{})
+
+func Init(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader, configSection *conf.ConfigSection) {
+	var config configData
+	if err := configSection.Decode(&config); err != nil {
+		logger.Fatal(fmt.Sprintf("fronius: %v", err))
 		return
 	}
 
 	for {
-		time.Sleep(20 * time.Second)
-
-		fetchPowerFlow(bus, logger, state, address)
-		fetchMeterData(bus, logger, state, address)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(config.PollInterval):
+		}
+
+		fetchPowerFlow(bus, logger, state, config.Address)
+		fetchMeterData(bus, logger, state, config.Address)
 	}
 }
 
 func fetchPowerFlow(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader, address string) {
 	powerFlowUrl := fmt.Sprintf("http://%s/solar_api/v1/GetPowerFlowRealtimeData.fcgi", address)
 
-	gridDrawWattsSensor := entities.NewSensorGauge(bus, "fronius.inverter.grid_draw_watts")
-	powerWattsSensor := entities.NewSensorGauge(bus, "fronius.inverter.power_watts")
-	generationWattsSensor := entities.NewSensorGauge(bus, "fronius.inverter.generation_watts")
-	energyDayWhSensor := entities.NewSensorGauge(bus, "fronius.inverter.energy_day_watt_hours")
+	gridDrawWattsSensor := entities.NewSensorGauge(bus, "fronius.inverter.grid_draw_watts", entities.WithUnit("W"), entities.WithDeviceClass("power"))
+	powerWattsSensor := entities.NewSensorGauge(bus, "fronius.inverter.power_watts", entities.WithUnit("W"), entities.WithDeviceClass("power"))
+	generationWattsSensor := entities.NewSensorGauge(bus, "fronius.inverter.generation_watts", entities.WithUnit("W"), entities.WithDeviceClass("power"))
+	energyDayWhSensor := entities.NewSensorGauge(bus, "fronius.inverter.energy_day_watt_hours", entities.WithUnit("Wh"), entities.WithDeviceClass("energy"))
 
 	resp, err := http.Get(powerFlowUrl)
 
@@ -70,8 +83,8 @@ func fetchPowerFlow(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.
 func fetchMeterData(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader, address string) {
 	meterDataUrl := fmt.Sprintf("http://%s/solar_api/v1/GetMeterRealtimeData.cgi?Scope=System", address)
 
-	gridVoltageSensor := entities.NewSensorGauge(bus, "fronius.inverter.grid_voltage")
-	consumedKwHSensor := entities.NewSensorGauge(bus, "fronius.inverter.consumed_kwh")
+	gridVoltageSensor := entities.NewSensorGauge(bus, "fronius.inverter.grid_voltage", entities.WithUnit("V"), entities.WithDeviceClass("voltage"))
+	consumedKwHSensor := entities.NewSensorGauge(bus, "fronius.inverter.consumed_kwh", entities.WithUnit("kWh"), entities.WithDeviceClass("energy"))
 
 	resp, err := http.Get(meterDataUrl)
 	if err != nil {
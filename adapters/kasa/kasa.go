@@ -1,6 +1,7 @@
 package kasa
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
@@ -15,51 +16,59 @@ import (
 )
 
 type configData struct {
-	address string
-	name    string
+	Name         string        `config:"name,required"`
+	Address      string        `config:"address,required"`
+	PollInterval time.Duration `config:"poll_interval" default:"20s"`
 }
 
-func Init(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader, configSection *conf.ConfigSection) {
+// ConfigSchema lists the keys Init reads from its config section
+var ConfigSchema = conf.SchemaFor(configData{})
+
+func Init(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader, configSection *conf.ConfigSection) {
 	var wg sync.WaitGroup
 
-	config, err := newConfigFromSection(configSection)
-	if err != nil {
+	var config configData
+	if err := configSection.Decode(&config); err != nil {
 		logger.Fatal(fmt.Sprintf("kasa: %v", err))
 		return
 	}
 
 	wg.Add(1)
 	go func() {
-		broadcastState(bus, logger, config)
+		broadcastState(ctx, bus, logger, config)
 		wg.Done()
 	}()
 
 	wg.Add(1)
 	go func() {
-		changeState(bus, logger, config)
+		changeState(ctx, bus, logger, config)
 		wg.Done()
 	}()
 
 	wg.Wait()
 }
 
-func broadcastState(bus *pubsub.Pubsub, logger *logging.Logger, config configData) {
-	dev := hs100.NewHs100(config.address, configuration.Default())
+func broadcastState(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, config configData) {
+	dev := hs100.NewHs100(config.Address, configuration.Default())
 
 	_, err := dev.GetName()
 	if err != nil {
-		logger.Fatal(fmt.Sprintf("kasa (%s): %v", config.name, err))
+		logger.Fatal(fmt.Sprintf("kasa (%s): %v", config.Name, err))
 		return
 	}
 
-	powerSensor := entities.NewSensorBoolean(bus, fmt.Sprintf("kasa.%s.on", config.name))
+	powerSensor := entities.NewSensorBoolean(bus, fmt.Sprintf("kasa.%s.on", config.Name), entities.WithDeviceClass("power_state"))
 
 	for {
-		time.Sleep(20 * time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(config.PollInterval):
+		}
 
 		on, err := dev.IsOn()
 		if err != nil {
-			logger.Error(fmt.Sprintf("kasa (%s): %v", config.name, err))
+			logger.Error(fmt.Sprintf("kasa (%s): %v", config.Name, err))
 			continue
 		}
 
@@ -67,52 +76,40 @@ func broadcastState(bus *pubsub.Pubsub, logger *logging.Logger, config configDat
 	}
 }
 
-func changeState(bus *pubsub.Pubsub, logger *logging.Logger, config configData) {
-	dev := hs100.NewHs100(config.address, configuration.Default())
+func changeState(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, config configData) {
+	dev := hs100.NewHs100(config.Address, configuration.Default())
 
 	_, err := dev.GetName()
 	if err != nil {
-		logger.Fatal(fmt.Sprintf("kasa (%s): %v", config.name, err))
+		logger.Fatal(fmt.Sprintf("kasa (%s): %v", config.Name, err))
 		return
 	}
 
-	subControl, _ := bus.Subscribe(fmt.Sprintf("kasa.%s.control", config.name))
+	subControl, _ := bus.Subscribe(ctx, fmt.Sprintf("kasa.%s.control", config.Name))
 	defer subControl.Close()
 
 	for event := range subControl.Ch {
 		if event.Key == "power" && event.Value == "off" {
 			err = dev.TurnOff()
 			if err != nil {
-				logger.Error(fmt.Sprintf("kasa (%s): error setting power to off: %v", config.name, err))
+				logger.Error(fmt.Sprintf("kasa (%s): error setting power to off: %v", config.Name, err))
+				bus.Reply(event, pubsub.NewReplyEvent(err))
 				continue
 			}
-			logger.Debug(fmt.Sprintf("kasa (%s): power changed to off", config.name))
+			logger.Debug(fmt.Sprintf("kasa (%s): power changed to off", config.Name))
+			bus.Reply(event, pubsub.NewReplyEvent(nil))
 		} else if event.Key == "power" && event.Value == "on" {
 			err = dev.TurnOn()
 			if err != nil {
-				logger.Error(fmt.Sprintf("kasa (%s): error setting power to on: %v", config.name, err))
+				logger.Error(fmt.Sprintf("kasa (%s): error setting power to on: %v", config.Name, err))
+				bus.Reply(event, pubsub.NewReplyEvent(err))
 				continue
 			}
-			logger.Debug(fmt.Sprintf("kasa (%s): power changed to on", config.name))
+			logger.Debug(fmt.Sprintf("kasa (%s): power changed to on", config.Name))
+			bus.Reply(event, pubsub.NewReplyEvent(nil))
 		} else {
-			logger.Error(fmt.Sprintf("kasa (%s): unrecognised event: %v", config.name, event))
+			logger.Error(fmt.Sprintf("kasa (%s): unrecognised event: %v", config.Name, event))
+			bus.Reply(event, pubsub.NewReplyEvent(fmt.Errorf("kasa (%s): unrecognised event", config.Name)))
 		}
 	}
 }
-
-func newConfigFromSection(configSection *conf.ConfigSection) (configData, error) {
-	name, err := configSection.GetString("name")
-	if err != nil {
-		return configData{}, fmt.Errorf("name not found in config")
-	}
-
-	address, err := configSection.GetString("address")
-	if err != nil {
-		return configData{}, fmt.Errorf("address not found in config for %s", name)
-	}
-
-	return configData{
-		address: address,
-		name:    name,
-	}, nil
-}
@@ -18,55 +18,67 @@ import (
 )
 
 type configData struct {
-	address string
-	name    string
+	Name         string        `config:"name,required"`
+	Address      string        `config:"address,required"`
+	PollInterval time.Duration `config:"poll_interval" default:"30s"`
 }
 
-func Init(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader, configSection *conf.ConfigSection) {
+// ConfigSchema lists the keys Init reads from its config section
+var ConfigSchema = conf.SchemaFor(configData{})
+
+func Init(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader, configSection *conf.ConfigSection) {
 	var wg sync.WaitGroup
 
-	config, err := newConfigFromSection(configSection)
-	if err != nil {
-		logger.Fatal(fmt.Sprintf("lifx (%s): %v", config.name, err))
+	var config configData
+	if err := configSection.Decode(&config); err != nil {
+		logger.Fatal(fmt.Sprintf("lifx (%s): %v", config.Name, err))
 		return
 	}
+	// lifx always listens on UDP port 56700
+	config.Address = fmt.Sprintf("%s:56700", config.Address)
 
 	wg.Add(1)
 	go func() {
-		broadcastState(bus, logger, config)
+		broadcastState(ctx, bus, logger, config)
 		wg.Done()
 	}()
 
 	wg.Add(1)
 	go func() {
-		changeState(bus, logger, config)
+		changeState(ctx, bus, logger, config)
 		wg.Done()
 	}()
 
 	wg.Wait()
 }
 
-func broadcastState(bus *pubsub.Pubsub, logger *logging.Logger, config configData) {
+func broadcastState(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, config configData) {
 	timeout := 2 * time.Second
 
-	ctx, _ := context.WithTimeout(context.Background(), timeout)
-	lifxDev := lifxlan.NewDevice(config.address, lifxlan.ServiceUDP, lifxlan.AllDevices)
-	lightDev, err := light.Wrap(ctx, lifxDev, false)
+	wrapCtx, cancel := context.WithTimeout(ctx, timeout)
+	lifxDev := lifxlan.NewDevice(config.Address, lifxlan.ServiceUDP, lifxlan.AllDevices)
+	lightDev, err := light.Wrap(wrapCtx, lifxDev, false)
+	cancel()
 
 	if err != nil {
-		logger.Fatal(fmt.Sprintf("lifx (%s): %v", config.name, err))
+		logger.Fatal(fmt.Sprintf("lifx (%s): %v", config.Name, err))
 		return
 	}
 
-	colorSensor := entities.NewSensorString(bus, fmt.Sprintf("lifx.%s.color", config.name))
+	colorSensor := entities.NewSensorString(bus, fmt.Sprintf("lifx.%s.color", config.Name))
 
 	for {
-		time.Sleep(30 * time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(config.PollInterval):
+		}
 
-		ctx, _ := context.WithTimeout(context.Background(), timeout)
-		color, err := lightDev.GetColor(ctx, nil)
+		getCtx, cancel := context.WithTimeout(ctx, timeout)
+		color, err := lightDev.GetColor(getCtx, nil)
+		cancel()
 		if err != nil {
-			logger.Error(fmt.Sprintf("lifx (%s): error geetting color: %v", config.name, err))
+			logger.Error(fmt.Sprintf("lifx (%s): error geetting color: %v", config.Name, err))
 			continue
 		}
 
@@ -74,38 +86,45 @@ func broadcastState(bus *pubsub.Pubsub, logger *logging.Logger, config configDat
 	}
 }
 
-func changeState(bus *pubsub.Pubsub, logger *logging.Logger, config configData) {
+func changeState(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, config configData) {
 	timeout := 10 * time.Second
 
-	subControl, _ := bus.Subscribe(fmt.Sprintf("lifx.%s.control", config.name))
+	subControl, _ := bus.Subscribe(ctx, fmt.Sprintf("lifx.%s.control", config.Name))
 	defer subControl.Close()
 
 	for event := range subControl.Ch {
-		ctx, _ := context.WithTimeout(context.Background(), timeout)
-		lifxDev := lifxlan.NewDevice(config.address, lifxlan.ServiceUDP, lifxlan.AllDevices)
-		lightDev, err := light.Wrap(ctx, lifxDev, false)
+		wrapCtx, cancel := context.WithTimeout(ctx, timeout)
+		lifxDev := lifxlan.NewDevice(config.Address, lifxlan.ServiceUDP, lifxlan.AllDevices)
+		lightDev, err := light.Wrap(wrapCtx, lifxDev, false)
+		cancel()
 
 		if err != nil {
-			logger.Fatal(fmt.Sprintf("lifx (%s): error during changeState init: %v", config.name, err))
+			logger.Fatal(fmt.Sprintf("lifx (%s): error during changeState init: %v", config.Name, err))
+			bus.Reply(event, pubsub.NewReplyEvent(err))
 			continue
 		}
 
 		if event.Key == "color:set" {
 			color, err := deserialiseColor(event.Value)
 			if err != nil {
-				logger.Error(fmt.Sprintf("lifx (%s): error setting color: %v", config.name, err))
+				logger.Error(fmt.Sprintf("lifx (%s): error setting color: %v", config.Name, err))
+				bus.Reply(event, pubsub.NewReplyEvent(err))
 				continue
 			}
 
-			ctx, _ := context.WithTimeout(context.Background(), timeout)
-			err = lightDev.SetColor(ctx, nil, color, 0, true)
+			setCtx, cancel := context.WithTimeout(ctx, timeout)
+			err = lightDev.SetColor(setCtx, nil, color, 0, true)
+			cancel()
 			if err != nil {
-				logger.Error(fmt.Sprintf("lifx (%s): error setting color: %v", config.name, err))
+				logger.Error(fmt.Sprintf("lifx (%s): error setting color: %v", config.Name, err))
+				bus.Reply(event, pubsub.NewReplyEvent(err))
 				continue
 			}
-			logger.Debug(fmt.Sprintf("lifx (%s): color changed", config.name))
+			logger.Debug(fmt.Sprintf("lifx (%s): color changed", config.Name))
+			bus.Reply(event, pubsub.NewReplyEvent(nil))
 		} else {
-			logger.Error(fmt.Sprintf("lifx (%s): unrecognised event: %v", config.name, event))
+			logger.Error(fmt.Sprintf("lifx (%s): unrecognised event: %v", config.Name, event))
+			bus.Reply(event, pubsub.NewReplyEvent(fmt.Errorf("lifx (%s): unrecognised event", config.Name)))
 		}
 	}
 }
@@ -139,21 +158,3 @@ func deserialiseColor(value string) (*lifxlan.Color, error) {
 		}
 	}
 }
-
-func newConfigFromSection(configSection *conf.ConfigSection) (configData, error) {
-	name, err := configSection.GetString("name")
-	if err != nil {
-		return configData{}, fmt.Errorf("name not found in config")
-	}
-
-	address, err := configSection.GetString("address")
-	if err != nil {
-		return configData{}, fmt.Errorf("address not found in config")
-	}
-
-	// lifx always listens on UDP port 56700
-	return configData{
-		address: fmt.Sprintf("%s:56700", address),
-		name:    name,
-	}, nil
-}
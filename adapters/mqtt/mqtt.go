@@ -0,0 +1,324 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	conf "github.com/yob/home-data/core/config"
+	"github.com/yob/home-data/core/homestate"
+	"github.com/yob/home-data/core/logging"
+	"github.com/yob/home-data/pubsub"
+)
+
+const (
+	qos            = 1
+	publishTimeout = 10 * time.Second
+)
+
+// the broker might not need a login, and there might only be traffic in one direction, so
+// most of this is optional
+type configData struct {
+	Broker    string   `config:"broker,required"`
+	ClientID  string   `config:"client_id" default:"home-data"`
+	Username  string   `config:"username"`
+	Password  string   `config:"password"`
+	Prefix    string   `config:"topic_prefix" default:"home-data"`
+	Publish   []string `config:"publish"`
+	Subscribe []string `config:"subscribe"`
+	StateKeys []string `config:"state_keys"`
+}
+
+// The body of every MQTT message we send for a bus event, and what we expect to receive.
+// Messages that aren't JSON are what most devices and phone apps send, see plainEvent.
+type message struct {
+	Key     string          `json:"key,omitempty"`
+	Value   string          `json:"value,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Source  string          `json:"source,omitempty"`
+
+	// the client ID of the bridge that sent the message. The broker sends our own messages
+	// back to us if we're subscribed to the same topic, and this is how we spot them
+	Origin string `json:"origin,omitempty"`
+}
+
+// ConfigSchema lists the keys Init reads from its config section
+var ConfigSchema = conf.SchemaFor(configData{})
+
+// Bridges the bus to an MQTT broker. Bus topics are mapped to MQTT topics under a prefix,
+// with "." and ":" replaced by "/". For example, with the default prefix
+// daikin.kitchen.control is home-data/daikin/kitchen/control.
+//
+//	[mqtt]
+//	adapter = "mqtt"
+//	broker = "tcp://localhost:1883"
+//	publish = ["daikin.*.control"]    # bus topics to send to MQTT
+//	subscribe = ["daikin.*.control"]  # MQTT topics to publish on the bus
+//	state_keys = ["ruuvi.#"]          # state keys to mirror as retained messages
+//
+// The topics and keys can be patterns, using the same rules as pubsub.Subscribe. MQTT can't
+// tell "." and ":" apart, so a message from MQTT is put back on the bus using the
+// separators of the subscribe pattern it matched. state:# turns home-data/state/update
+// back into state:update, and anything covered by a "#" is joined with ".". State keys
+// are published to <prefix>/state/<key>, with the plain value as the message body so that
+// they're easy to use from other tools.
+//
+// Control topics expect a key and a value. A plain "on" or "off" sent to
+// home-data/daikin/kitchen/control turns the unit on or off, anything else needs JSON:
+//
+//	{"key": "power", "value": "on"}
+//	{"key": "color:set", "value": "26250,65535,39403,3500"}
+func Init(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader, configSection *conf.ConfigSection) {
+	var config configData
+	if err := configSection.Decode(&config); err != nil {
+		logger.Fatal(fmt.Sprintf("mqtt: %v", err))
+		return
+	}
+	config.Prefix = strings.TrimSuffix(config.Prefix, "/")
+
+	opts := paho.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(config.ClientID).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOnConnectHandler(func(client paho.Client) {
+			logger.Debug(fmt.Sprintf("mqtt: connected to %s", config.Broker))
+			// subscriptions don't survive a reconnect, so they're made every time
+			subscribe(bus, logger, client, config)
+		}).
+		SetConnectionLostHandler(func(client paho.Client, err error) {
+			logger.Error(fmt.Sprintf("mqtt: lost connection to %s - %v", config.Broker, err))
+		})
+
+	client := paho.NewClient(opts)
+	token := client.Connect()
+	select {
+	case <-token.Done():
+		if err := token.Error(); err != nil {
+			logger.Fatal(fmt.Sprintf("mqtt: error connecting to %s - %v", config.Broker, err))
+			return
+		}
+	case <-ctx.Done():
+		client.Disconnect(250)
+		return
+	}
+	defer client.Disconnect(250)
+
+	var wg sync.WaitGroup
+	for _, pattern := range config.Publish {
+		wg.Add(1)
+		go func() {
+			mirrorTopic(ctx, bus, logger, client, config, pattern)
+			wg.Done()
+		}()
+	}
+
+	if len(config.StateKeys) > 0 {
+		wg.Add(1)
+		go func() {
+			mirrorState(ctx, bus, logger, client, config)
+			wg.Done()
+		}()
+	}
+
+	wg.Wait()
+}
+
+// send bus events on topics matching pattern to MQTT
+func mirrorTopic(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, client paho.Client, config configData, pattern string) {
+	sub, _ := bus.Subscribe(ctx, pattern)
+	defer sub.Close()
+
+	for event := range sub.Ch {
+		// we published this event after receiving it from MQTT, so it's already there
+		if event.Source == bus.Source() {
+			continue
+		}
+
+		msg := message{
+			Key:    event.Key,
+			Value:  event.Value,
+			Source: event.Source,
+			Origin: config.ClientID,
+		}
+		if event.Payload != nil {
+			payload, err := json.Marshal(event.Payload)
+			if err != nil {
+				logger.Error(fmt.Sprintf("mqtt: unable to encode payload for %s - %v", event.Topic, err))
+				continue
+			}
+			msg.Payload = payload
+		}
+		body, err := json.Marshal(msg)
+		if err != nil {
+			logger.Error(fmt.Sprintf("mqtt: unable to encode event for %s - %v", event.Topic, err))
+			continue
+		}
+
+		publish(logger, client, busToMQTTTopic(config.Prefix, event.Topic), false, body)
+	}
+}
+
+// send changes to interesting state keys to MQTT as retained messages, so anything that
+// connects later gets the latest value straight away. If MQTT is slow there's no point
+// sending values that have already been replaced
+func mirrorState(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, client paho.Client, config configData) {
+	sub, err := pubsub.Subscribe[homestate.Change](ctx, bus, "state:changed", pubsub.WithDropPolicy(pubsub.CoalesceByKey))
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("mqtt: unable to subscribe to state changes - %v", err))
+		return
+	}
+	defer sub.Close()
+
+	for event := range sub.Ch {
+		change := event.Payload
+		if !matchAny(config.StateKeys, change.Key) {
+			continue
+		}
+		// an empty retained message clears the retained value
+		var body []byte
+		if !change.Deleted {
+			body = []byte(change.New.String())
+		}
+		publish(logger, client, stateTopic(config.Prefix, change.Key), true, body)
+	}
+}
+
+func publish(logger *logging.Logger, client paho.Client, topic string, retained bool, body []byte) {
+	token := client.Publish(topic, qos, retained, body)
+	if !token.WaitTimeout(publishTimeout) {
+		logger.Error(fmt.Sprintf("mqtt: timed out publishing to %s", topic))
+		return
+	}
+	if err := token.Error(); err != nil {
+		logger.Error(fmt.Sprintf("mqtt: error publishing to %s - %v", topic, err))
+	}
+}
+
+func subscribe(bus *pubsub.Pubsub, logger *logging.Logger, client paho.Client, config configData) {
+	for _, pattern := range config.Subscribe {
+		filter := busToMQTTTopic(config.Prefix, pattern)
+		token := client.Subscribe(filter, qos, func(client paho.Client, msg paho.Message) {
+			receive(bus, logger, config, msg)
+		})
+		go func() {
+			token.Wait()
+			if err := token.Error(); err != nil {
+				logger.Error(fmt.Sprintf("mqtt: error subscribing to %s - %v", filter, err))
+			}
+		}()
+	}
+}
+
+// publish a message from MQTT on the bus
+func receive(bus *pubsub.Pubsub, logger *logging.Logger, config configData, msg paho.Message) {
+	topic, ok := mqttToBusTopic(config.Prefix, config.Subscribe, msg.Topic())
+	if !ok {
+		return
+	}
+
+	var body message
+	if err := json.Unmarshal(msg.Payload(), &body); err != nil {
+		bus.Publish(topic, plainEvent(topic, string(msg.Payload())))
+		return
+	}
+	if body.Origin == config.ClientID {
+		return
+	}
+
+	if len(body.Payload) == 0 {
+		bus.Publish(topic, pubsub.NewKeyValueEvent(body.Key, body.Value))
+		return
+	}
+
+	payloadType, ok := pubsub.PayloadType(topic)
+	if !ok {
+		logger.Error(fmt.Sprintf("mqtt: received a payload for %s, but it has no payload type", topic))
+		return
+	}
+	payload := reflect.New(payloadType)
+	if err := json.Unmarshal(body.Payload, payload.Interface()); err != nil {
+		logger.Error(fmt.Sprintf("mqtt: unable to decode payload for %s - %v", topic, err))
+		return
+	}
+	bus.Publish(topic, pubsub.NewTypedEvent(payload.Elem().Interface()))
+}
+
+// A message body that isn't JSON becomes a value event. The adapters with a control topic
+// want on and off as the power key though, so those are converted
+func plainEvent(topic string, body string) pubsub.EventData {
+	power := strings.ToLower(strings.TrimSpace(body))
+	if strings.HasSuffix(topic, ".control") && (power == "on" || power == "off") {
+		return pubsub.NewKeyValueEvent("power", power)
+	}
+	return pubsub.NewValueEvent(body)
+}
+
+// daikin.kitchen.control -> home-data/daikin/kitchen/control. Also converts bus patterns to
+// MQTT filters, "*" and "#" become "+" and "#"
+func busToMQTTTopic(prefix string, topic string) string {
+	replacer := strings.NewReplacer(".", "/", ":", "/", "*", "+")
+	return prefix + "/" + replacer.Replace(topic)
+}
+
+// home-data/daikin/kitchen/control -> daikin.kitchen.control. MQTT has no way to tell "."
+// and ":" apart, so the separators come from the first pattern in patterns that the topic
+// fits. Returns false if the topic isn't under prefix, or doesn't fit any of the patterns
+func mqttToBusTopic(prefix string, patterns []string, topic string) (string, bool) {
+	rest, ok := strings.CutPrefix(topic, prefix+"/")
+	if !ok || rest == "" {
+		return "", false
+	}
+	segments := strings.Split(rest, "/")
+
+	for _, pattern := range patterns {
+		busTopic, ok := joinLike(pattern, segments)
+		if ok && pubsub.MatchTopic(pattern, busTopic) {
+			return busTopic, true
+		}
+	}
+	return "", false
+}
+
+// join segments with the same separators as pattern. Segments covered by a "#" are joined
+// with "."
+func joinLike(pattern string, segments []string) (string, bool) {
+	var result strings.Builder
+	for idx, segment := range segments {
+		if idx > 0 {
+			sepIdx := strings.IndexAny(pattern, ".:")
+			switch {
+			case sepIdx >= 0:
+				result.WriteByte(pattern[sepIdx])
+				pattern = pattern[sepIdx+1:]
+			case pattern == "#":
+				result.WriteByte('.')
+			default:
+				// more segments than the pattern has
+				return "", false
+			}
+		}
+		result.WriteString(segment)
+	}
+	return result.String(), true
+}
+
+func stateTopic(prefix string, key string) string {
+	return busToMQTTTopic(prefix, "state."+key)
+}
+
+func matchAny(patterns []string, topic string) bool {
+	for _, pattern := range patterns {
+		if pubsub.MatchTopic(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
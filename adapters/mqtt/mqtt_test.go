@@ -0,0 +1,130 @@
+package mqtt
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/yob/home-data/core/logging"
+	"github.com/yob/home-data/pubsub"
+)
+
+func TestBusToMQTTTopic(t *testing.T) {
+	tests := []struct {
+		topic string
+		want  string
+	}{
+		{"daikin.kitchen.control", "home-data/daikin/kitchen/control"},
+		{"email:send", "home-data/email/send"},
+		{"daikin.*.control", "home-data/daikin/+/control"},
+		{"state:#", "home-data/state/#"},
+		{"#", "home-data/#"},
+	}
+	for _, test := range tests {
+		if got := busToMQTTTopic("home-data", test.topic); got != test.want {
+			t.Errorf("busToMQTTTopic(%s) = %s, want %s", test.topic, got, test.want)
+		}
+	}
+}
+
+func TestMQTTToBusTopic(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		topic    string
+		want     string
+		ok       bool
+	}{
+		{[]string{"daikin.*.control"}, "home-data/daikin/kitchen/control", "daikin.kitchen.control", true},
+		{[]string{"email:send"}, "home-data/email/send", "email:send", true},
+		{[]string{"state:#"}, "home-data/state/update", "state:update", true},
+		{[]string{"state:#"}, "home-data/state/ruuvi/kitchen", "state:ruuvi.kitchen", true},
+		{[]string{"#"}, "home-data/email/send", "email.send", true},
+		{[]string{"daikin.*.control", "email:send"}, "home-data/email/send", "email:send", true},
+		// doesn't fit any pattern
+		{[]string{"email:send"}, "home-data/email/send/extra", "", false},
+		{[]string{"daikin.*.control"}, "home-data/kasa/heater/control", "", false},
+		// not under the prefix
+		{[]string{"#"}, "other/email/send", "", false},
+		{[]string{"#"}, "home-data/", "", false},
+	}
+	for _, test := range tests {
+		got, ok := mqttToBusTopic("home-data", test.patterns, test.topic)
+		if got != test.want || ok != test.ok {
+			t.Errorf("mqttToBusTopic(%v, %s) = %s, %v, want %s, %v", test.patterns, test.topic, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+type fakeMessage struct {
+	topic   string
+	payload string
+}
+
+func (m fakeMessage) Duplicate() bool   { return false }
+func (m fakeMessage) Qos() byte         { return qos }
+func (m fakeMessage) Retained() bool    { return false }
+func (m fakeMessage) Topic() string     { return m.topic }
+func (m fakeMessage) MessageID() uint16 { return 0 }
+func (m fakeMessage) Payload() []byte   { return []byte(m.payload) }
+func (m fakeMessage) Ack()              {}
+
+func TestReceiveSkipsOwnMessages(t *testing.T) {
+	ps := pubsub.NewPubsub()
+	go ps.Run()
+	defer ps.Shutdown(context.Background())
+
+	sub, _ := ps.Subscribe(context.Background(), "#")
+	defer sub.Close()
+
+	config := configData{
+		ClientID:  "home-data",
+		Prefix:    "home-data",
+		Subscribe: []string{"email:send", "daikin.*.control"},
+	}
+	logger := logging.NewLogger(ps)
+
+	// the broker echoes back what we published, which would loop forever
+	receive(ps, logger, config, fakeMessage{"home-data/email/send", `{"key":"a","origin":"home-data"}`})
+	// from another bridge, and from a device that doesn't send JSON
+	receive(ps, logger, config, fakeMessage{"home-data/email/send", `{"key":"b","origin":"other"}`})
+	receive(ps, logger, config, fakeMessage{"home-data/daikin/study/control", `off`})
+
+	want := []struct{ topic, key, value string }{
+		{"email:send", "b", ""},
+		{"daikin.study.control", "power", "off"},
+	}
+	for _, expected := range want {
+		select {
+		case event := <-sub.Ch:
+			if event.Topic != expected.topic || event.Key != expected.key || event.Value != expected.value {
+				t.Errorf("received %s %s=%s, want %s %s=%s", event.Topic, event.Key, event.Value, expected.topic, expected.key, expected.value)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s wasn't published", expected.topic)
+		}
+	}
+	select {
+	case event := <-sub.Ch:
+		t.Errorf("unexpected event %s %s", event.Topic, event.Key)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPlainEvent(t *testing.T) {
+	tests := []struct {
+		topic, body string
+		key, value  string
+	}{
+		{"daikin.kitchen.control", "on", "power", "on"},
+		{"kasa.heater.control", "OFF\n", "power", "off"},
+		// other controls need JSON
+		{"lifx.energylight.control", "26250,65535,39403,3500", "", "26250,65535,39403,3500"},
+		{"phone.location", "on", "", "on"},
+	}
+	for _, test := range tests {
+		event := plainEvent(test.topic, test.body)
+		if event.Key != test.key || event.Value != test.value {
+			t.Errorf("plainEvent(%s, %q) = %s=%s, want %s=%s", test.topic, test.body, event.Key, event.Value, test.key, test.value)
+		}
+	}
+}
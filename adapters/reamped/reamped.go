@@ -1,6 +1,7 @@
 package reamped
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -17,9 +18,12 @@ const (
 	feedInCentsPerKwh  = 3.30
 )
 
-func Init(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader, config *conf.ConfigSection) {
-	generalCentsPerKwhSensor := entities.NewSensorGauge(bus, "reamped.general.cents_per_kwh")
-	feedinCentsPerKwhSensor := entities.NewSensorGauge(bus, "reamped.feedin.cents_per_kwh")
+// ConfigSchema is empty, there's nothing to configure
+var ConfigSchema = conf.Schema{}
+
+func Init(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader, config *conf.ConfigSection) {
+	generalCentsPerKwhSensor := entities.NewSensorGauge(bus, "reamped.general.cents_per_kwh", entities.WithUnit("c/kWh"), entities.WithDeviceClass("monetary"))
+	feedinCentsPerKwhSensor := entities.NewSensorGauge(bus, "reamped.feedin.cents_per_kwh", entities.WithUnit("c/kWh"), entities.WithDeviceClass("monetary"))
 
 	for {
 		loc, err := time.LoadLocation("Australia/Melbourne")
@@ -36,7 +40,12 @@ func Init(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReade
 			generalCentsPerKwhSensor.Update(peakCentsPerKwh)
 		}
 		feedinCentsPerKwhSensor.Update(feedInCentsPerKwh)
-		time.Sleep(60 * time.Second)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(60 * time.Second):
+		}
 	}
 
 }
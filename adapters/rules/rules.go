@@ -1,6 +1,7 @@
 package rules
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
@@ -9,251 +10,233 @@ import (
 	"github.com/yob/home-data/core/entities"
 	"github.com/yob/home-data/core/homestate"
 	"github.com/yob/home-data/core/logging"
+	"github.com/yob/home-data/core/statebus"
 	"github.com/yob/home-data/pubsub"
 )
 
-func Init(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader, configSection *conf.ConfigSection) {
+const (
+	// how long to wait for a device adapter to confirm it has acted on a control event
+	controlTimeout = 30 * time.Second
+)
+
+// ConfigSchema is empty, there's nothing to configure
+var ConfigSchema = conf.Schema{}
+
+func Init(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader, configSection *conf.ConfigSection) {
 	var wg sync.WaitGroup
 
 	wg.Add(1)
 	go func() {
-		kitchenHeatingOnColdMornings(bus, logger, state)
+		kitchenHeatingOnColdMornings(ctx, bus, logger, state)
 		wg.Done()
 	}()
 
 	//wg.Add(1)
 	//go func() {
-	//	acOffOnPriceSpikes(bus, logger, state)
+	//	acOffOnPriceSpikes(ctx, bus, logger, state)
 	//	wg.Done()
 	//}()
 
 	wg.Add(1)
 	go func() {
-		reccomendOpenHouse(bus, logger, state)
+		reccomendOpenHouse(ctx, bus, logger, state)
 		wg.Done()
 	}()
 
 	wg.Add(1)
 	go func() {
-		cheapPowerOn(bus, logger, state)
+		cheapPowerOn(ctx, bus, logger, state)
 		wg.Done()
 	}()
 
 	wg.Add(1)
 	go func() {
-		cheapPowerOff(bus, logger, state)
+		cheapPowerOff(ctx, bus, logger, state)
 		wg.Done()
 	}()
 
 	wg.Add(1)
 	go func() {
-		effectivePrice(bus, logger, state)
+		effectivePrice(ctx, bus, logger, state)
 		wg.Done()
 	}()
 
 	wg.Add(1)
 	go func() {
-		setPowerPricesLight(bus, logger, state)
+		setPowerPricesLight(ctx, bus, logger, state)
 		wg.Done()
 	}()
 
 	wg.Wait()
 }
 
-func kitchenHeatingOnColdMornings(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader) {
-	publish := bus.PublishChannel()
-	sub, _ := bus.Subscribe("every:minute")
+func kitchenHeatingOnColdMornings(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader) {
+	sub, _ := bus.Subscribe(ctx, "every:minute")
 	defer sub.Close()
 
-	for _ = range sub.Ch {
+	for event := range sub.Ch {
 		logger.Debug("rules: executing kitchenHeatingOnColdMornings")
+		now := eventTime(event)
 		// TODO only mon-fri
-		condOne := time.Now().Hour() == 6
+		condOne := now.Hour() == 6
 
-		lastAt, ok := state.ReadTime("kitchenHeatingOnColdMornings_last_at")
-		condTwo := !ok || time.Since(lastAt) > 12*time.Hour
+		lastAt, lastAtOk := state.ReadValue("kitchenHeatingOnColdMornings_last_at")
+		condTwo := !lastAtOk || ranBefore(lastAt, now.Add(-12*time.Hour))
 
-		jamesLastSeenAt, jamesOk := state.ReadTime("unifi.presence.last_seen.james")
-		andreaLastSeenAt, andreaOk := state.ReadTime("unifi.presence.last_seen.andrea")
-		condThree := (jamesOk && time.Since(jamesLastSeenAt) < 1*time.Hour) || (andreaOk && time.Since(andreaLastSeenAt) < 1*time.Hour)
+		jamesLastSeenAt, jamesErr := state.ReadTime("unifi.presence.last_seen.james")
+		andreaLastSeenAt, andreaErr := state.ReadTime("unifi.presence.last_seen.andrea")
+		condThree := (jamesErr == nil && now.Sub(jamesLastSeenAt) < 1*time.Hour) || (andreaErr == nil && now.Sub(andreaLastSeenAt) < 1*time.Hour)
 
-		kitchenCelcius, ok := state.ReadFloat64("ruuvi.kitchen.temp_celcius")
-		condFour := ok && kitchenCelcius <= 14
+		kitchenCelcius, err := state.ReadFloat64("ruuvi.kitchen.temp_celcius")
+		condFour := err == nil && kitchenCelcius <= 14
 
 		logger.Debug(fmt.Sprintf("rules: evaluating kitchenHeatingOnColdMornings - condOne: %t, condTwo: %t, condThree: %t, condFour: %t", condOne, condTwo, condThree, condFour))
 
 		if condOne && condTwo && condThree && condFour {
-			publish <- pubsub.PubsubEvent{
-				Topic: "daikin.kitchen.control",
-				Data:  pubsub.NewKeyValueEvent("power", "on"),
+			previous := homestate.Expect("kitchenHeatingOnColdMornings_last_at", lastAt, lastAtOk)
+			if !claimRun(ctx, bus, logger, previous, now) {
+				continue
 			}
 
-			publish <- pubsub.PubsubEvent{
-				Topic: "email:send",
-				Data:  pubsub.NewEmailEvent("[home-data] Cold morning - kitchen AC turned on", "I did a thing"),
+			err := sendControl(ctx, bus, "daikin.kitchen.control", pubsub.NewKeyValueEvent("power", "on"))
+			if err != nil {
+				logger.Error(fmt.Sprintf("rules: kitchenHeatingOnColdMornings failed to turn on kitchen AC - %v", err))
+				releaseRun(ctx, bus, logger, previous, now)
+				continue
 			}
 
-			publish <- pubsub.PubsubEvent{
-				Topic: "state:update",
-				Data:  pubsub.NewKeyValueEvent("kitchenHeatingOnColdMornings_last_at", time.Now().UTC().Format(time.RFC3339)),
-			}
+			sendEmail(bus, logger, "[home-data] Cold morning - kitchen AC turned on", "I did a thing")
 		}
 	}
 }
 
-func reccomendOpenHouse(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader) {
-	publish := bus.PublishChannel()
-	sub, _ := bus.Subscribe("every:minute")
+func reccomendOpenHouse(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader) {
+	sub, _ := bus.Subscribe(ctx, "every:minute")
 	defer sub.Close()
 
-	for _ = range sub.Ch {
+	for event := range sub.Ch {
 		logger.Debug("rules: executing reccomendOpenHouse")
-		outsideAbsHumidity, ok := state.ReadFloat64("ruuvi.outside.absolute_humidity_g_per_m3")
-		condOne := ok && outsideAbsHumidity <= 7
+		now := eventTime(event)
+		outsideAbsHumidity, err := state.ReadFloat64("ruuvi.outside.absolute_humidity_g_per_m3")
+		condOne := err == nil && outsideAbsHumidity <= 7
 
-		kitchenAbsHumidity, ok := state.ReadFloat64("ruuvi.kitchen.absolute_humidity_g_per_m3")
-		condTwo := ok && kitchenAbsHumidity >= 9
+		kitchenAbsHumidity, err := state.ReadFloat64("ruuvi.kitchen.absolute_humidity_g_per_m3")
+		condTwo := err == nil && kitchenAbsHumidity >= 9
 
-		outsideTemp, ok := state.ReadFloat64("ruuvi.outside.temp_celcius")
-		condThree := ok && outsideTemp >= 15
+		outsideTemp, err := state.ReadFloat64("ruuvi.outside.temp_celcius")
+		condThree := err == nil && outsideTemp >= 15
 
-		condFour := ok && outsideTemp < 30
+		condFour := err == nil && outsideTemp < 30
 
-		lastAt, ok := state.ReadTime("reccomendOpenHouse_last_at")
-		condFive := !ok || time.Since(lastAt) > 12*time.Hour
+		lastAt, lastAtOk := state.ReadValue("reccomendOpenHouse_last_at")
+		condFive := !lastAtOk || ranBefore(lastAt, now.Add(-12*time.Hour))
 
 		logger.Debug(fmt.Sprintf("rules: evaluating reccomendOpenHouse - condOne: %t condTwo: %t condThree: %t condFour: %t condFive: %t", condOne, condTwo, condThree, condFour, condFive))
 
 		if condOne && condTwo && condThree && condFour && condFive {
-
-			publish <- pubsub.PubsubEvent{
-				Topic: "email:send",
-				Data:  pubsub.NewEmailEvent("[home-data] Reccommend opening the house", "Humidity inside is high, humidity outside is low, temp outside is mild. Get some fresh air flowing!"),
+			previous := homestate.Expect("reccomendOpenHouse_last_at", lastAt, lastAtOk)
+			if !claimRun(ctx, bus, logger, previous, now) {
+				continue
 			}
 
-			publish <- pubsub.PubsubEvent{
-				Topic: "state:update",
-				Data:  pubsub.NewKeyValueEvent("reccomendOpenHouse_last_at", time.Now().UTC().Format(time.RFC3339)),
-			}
+			sendEmail(bus, logger, "[home-data] Reccommend opening the house", "Humidity inside is high, humidity outside is low, temp outside is mild. Get some fresh air flowing!")
 		}
 	}
 }
 
-//func acOffOnPriceSpikes(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader) {
-//	publish := bus.PublishChannel()
-//	sub, _ := bus.Subscribe("every:minute")
+//func acOffOnPriceSpikes(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader) {
+//	sub, _ := bus.Subscribe(ctx, "every:minute")
 //	defer sub.Close()
 //
 //	for _ = range sub.Ch {
 //		logger.Debug("rules: executing acOffOnPriceSpikes")
-//		effectiveCentsPerKwh, ok := state.ReadFloat64("effective_cents_per_kwh")
-//		condOne := ok && effectiveCentsPerKwh > 150
+//		effectiveCentsPerKwh, err := state.ReadFloat64("effective_cents_per_kwh")
+//		condOne := err == nil && effectiveCentsPerKwh > 150
 //
 //		logger.Debug(fmt.Sprintf("rules: evaluating acOffOnPriceSpikes - condOne: %t", condOne))
 //
 //		if condOne {
-//			publish <- pubsub.PubsubEvent{
-//				Topic: "daikin.kitchen.control",
-//				Data:  pubsub.NewKeyValueEvent("power", "off"),
-//			}
+//			bus.Publish("daikin.kitchen.control", pubsub.NewKeyValueEvent("power", "off"))
 //
-//			publish <- pubsub.PubsubEvent{
-//				Topic: "daikin.study.control",
-//				Data:  pubsub.NewKeyValueEvent("power", "off"),
-//			}
+//			bus.Publish("daikin.study.control", pubsub.NewKeyValueEvent("power", "off"))
 //
-//			publish <- pubsub.PubsubEvent{
-//				Topic: "daikin.lounge.control",
-//				Data:  pubsub.NewKeyValueEvent("power", "off"),
-//			}
+//			bus.Publish("daikin.lounge.control", pubsub.NewKeyValueEvent("power", "off"))
 //
-//			publish <- pubsub.PubsubEvent{
-//				Topic: "email:send",
-//				Data:  pubsub.NewEmailEvent("[home-data] Price spike! AC turned off", "I did a thing"),
-//			}
+//			sendEmail(bus, logger, "[home-data] Price spike! AC turned off", "I did a thing")
 //
-//			publish <- pubsub.PubsubEvent{
-//				Topic: "state:update",
-//				Data:  pubsub.NewKeyValueEvent("acOffOnPriceSpikes_last_at", time.Now().UTC().Format(time.RFC3339)),
-//			}
+//			recordLastAt(ctx, bus, logger, "acOffOnPriceSpikes_last_at", time.Now())
 //		}
 //	}
 //}
 
-func cheapPowerOn(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader) {
-	publish := bus.PublishChannel()
-	sub, _ := bus.Subscribe("every:minute")
+func cheapPowerOn(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader) {
+	sub, _ := bus.Subscribe(ctx, "every:minute")
 	defer sub.Close()
 
-	for _ = range sub.Ch {
+	for event := range sub.Ch {
 		logger.Debug("rules: executing cheapPowerOn")
-		effectiveCentsPerKwh, ok := state.ReadFloat64("effective_cents_per_kwh")
-		condOne := ok && effectiveCentsPerKwh < 18
+		effectiveCentsPerKwh, err := state.ReadFloat64("effective_cents_per_kwh")
+		condOne := err == nil && effectiveCentsPerKwh < 18
 
-		lowPricesOn, ok := state.Read("kasa.low-prices.on")
-		condTwo := ok && lowPricesOn == "0"
+		lowPricesOn, err := state.ReadBool("kasa.low-prices.on")
+		condTwo := err == nil && !lowPricesOn
 
 		logger.Debug(fmt.Sprintf("rules: evaluating cheapPowerOn - condOne: %t condTwo: %t", condOne, condTwo))
 
 		if condOne && condTwo {
-			publish <- pubsub.PubsubEvent{
-				Topic: "kasa.low-prices.control",
-				Data:  pubsub.NewKeyValueEvent("power", "on"),
-			}
-			publish <- pubsub.PubsubEvent{
-				Topic: "state:update",
-				Data:  pubsub.NewKeyValueEvent("cheapPowerOn_last_at", time.Now().UTC().Format(time.RFC3339)),
+			err := sendControl(ctx, bus, "kasa.low-prices.control", pubsub.NewKeyValueEvent("power", "on"))
+			if err != nil {
+				logger.Error(fmt.Sprintf("rules: cheapPowerOn failed to turn on low-prices plug - %v", err))
+				continue
 			}
+			recordLastAt(ctx, bus, logger, "cheapPowerOn_last_at", eventTime(event))
 		}
 	}
 }
 
-func cheapPowerOff(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader) {
-	publish := bus.PublishChannel()
-	sub, _ := bus.Subscribe("every:minute")
+func cheapPowerOff(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader) {
+	sub, _ := bus.Subscribe(ctx, "every:minute")
 	defer sub.Close()
 
-	for _ = range sub.Ch {
+	for event := range sub.Ch {
 		logger.Debug("rules: executing cheapPowerOff")
-		effectiveCentsPerKwh, ok := state.ReadFloat64("effective_cents_per_kwh")
-		condOne := ok && effectiveCentsPerKwh >= 18
+		effectiveCentsPerKwh, err := state.ReadFloat64("effective_cents_per_kwh")
+		condOne := err == nil && effectiveCentsPerKwh >= 18
 
-		lowPricesOn, ok := state.Read("kasa.low-prices.on")
-		condTwo := ok && lowPricesOn == "1"
+		lowPricesOn, err := state.ReadBool("kasa.low-prices.on")
+		condTwo := err == nil && lowPricesOn
 
 		logger.Debug(fmt.Sprintf("rules: evaluating cheapPowerOff - condOne: %t condTwo: %t", condOne, condTwo))
 
 		if condOne && condTwo {
-			publish <- pubsub.PubsubEvent{
-				Topic: "kasa.low-prices.control",
-				Data:  pubsub.NewKeyValueEvent("power", "off"),
-			}
-			publish <- pubsub.PubsubEvent{
-				Topic: "state:update",
-				Data:  pubsub.NewKeyValueEvent("cheapPowerOff_last_at", time.Now().UTC().Format(time.RFC3339)),
+			err := sendControl(ctx, bus, "kasa.low-prices.control", pubsub.NewKeyValueEvent("power", "off"))
+			if err != nil {
+				logger.Error(fmt.Sprintf("rules: cheapPowerOff failed to turn off low-prices plug - %v", err))
+				continue
 			}
+			recordLastAt(ctx, bus, logger, "cheapPowerOff_last_at", eventTime(event))
 		}
 	}
 }
 
-func effectivePrice(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader) {
-	sub, _ := bus.Subscribe("every:minute")
+func effectivePrice(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader) {
+	sub, _ := bus.Subscribe(ctx, "every:minute")
 	defer sub.Close()
 
 	for _ = range sub.Ch {
 		logger.Debug("rules: executing effectivePrice")
 
-		reampedGeneralCentsPerKwh, ok := state.ReadFloat64("reamped.general.cents_per_kwh")
-		condOne := ok
+		reampedGeneralCentsPerKwh, err := state.ReadFloat64("reamped.general.cents_per_kwh")
+		condOne := err == nil
 
-		gridDrawWatts, ok := state.ReadFloat64("fronius.inverter.grid_draw_watts")
-		condTwo := ok
+		gridDrawWatts, err := state.ReadFloat64("fronius.inverter.grid_draw_watts")
+		condTwo := err == nil
 
 		condThree := gridDrawWatts <= 0
 
 		logger.Debug(fmt.Sprintf("rules: evaluating effectivePrice - condOne: %t condTwo: %t condThree: %t", condOne, condTwo, condThree))
 
-		effectivePriceSensor := entities.NewSensorGauge(bus, "effective_cents_per_kwh")
+		effectivePriceSensor := entities.NewSensorGauge(bus, "effective_cents_per_kwh", entities.WithUnit("c/kWh"), entities.WithDeviceClass("monetary"))
 
 		// We're exporting to the grid, so we're generating more than we're using and electricity is free to use!
 		if condOne && condTwo && condThree {
@@ -267,35 +250,106 @@ func effectivePrice(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.
 	}
 }
 
-func setPowerPricesLight(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader) {
-	publish := bus.PublishChannel()
-	sub, _ := bus.Subscribe("every:minute")
+func setPowerPricesLight(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader) {
+	sub, _ := bus.Subscribe(ctx, "every:minute")
 	defer sub.Close()
 
 	for _ = range sub.Ch {
 		logger.Debug("rules: executing setPowerPricesLight")
-		effectiveCentsPerKwh, ok := state.ReadFloat64("effective_cents_per_kwh")
-		condOne := ok && effectiveCentsPerKwh < 20
-		condTwo := ok && effectiveCentsPerKwh >= 20 && effectiveCentsPerKwh < 21
-		condThree := ok && effectiveCentsPerKwh >= 21
+		effectiveCentsPerKwh, readErr := state.ReadFloat64("effective_cents_per_kwh")
+		condOne := readErr == nil && effectiveCentsPerKwh < 20
+		condTwo := readErr == nil && effectiveCentsPerKwh >= 20 && effectiveCentsPerKwh < 21
+		condThree := readErr == nil && effectiveCentsPerKwh >= 21
 
 		logger.Debug(fmt.Sprintf("rules: evaluating setPowerPricesLight - condOne: %t condTwo: %t condThree: %t", condOne, condTwo, condThree))
 
+		var err error
 		if condOne { // green
-			publish <- pubsub.PubsubEvent{
-				Topic: "lifx.energylight.control",
-				Data:  pubsub.NewKeyValueEvent("color:set", "26250,65535,39403,3500"),
-			}
+			err = sendControl(ctx, bus, "lifx.energylight.control", pubsub.NewKeyValueEvent("color:set", "26250,65535,39403,3500"))
 		} else if condTwo { // orange
-			publish <- pubsub.PubsubEvent{
-				Topic: "lifx.energylight.control",
-				Data:  pubsub.NewKeyValueEvent("color:set", "4480,65535,39403,3500"),
-			}
+			err = sendControl(ctx, bus, "lifx.energylight.control", pubsub.NewKeyValueEvent("color:set", "4480,65535,39403,3500"))
 		} else if condThree { // red
-			publish <- pubsub.PubsubEvent{
-				Topic: "lifx.energylight.control",
-				Data:  pubsub.NewKeyValueEvent("color:set", "1289,65535,39403,3500"),
-			}
+			err = sendControl(ctx, bus, "lifx.energylight.control", pubsub.NewKeyValueEvent("color:set", "1289,65535,39403,3500"))
 		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("rules: setPowerPricesLight failed to set energylight color - %v", err))
+		}
+	}
+}
+
+// every:minute events carry the time they were generated. Rules should use that instead of
+// time.Now() so they make the same decisions when a journal is replayed
+func eventTime(event pubsub.EventData) time.Time {
+	t, err := time.Parse(time.RFC3339, event.Value)
+	if err != nil {
+		return time.Now()
+	}
+	return t
+}
+
+// publish a control event to a device adapter and wait until it confirms the change was made
+func sendControl(ctx context.Context, bus *pubsub.Pubsub, topic string, data pubsub.EventData) error {
+	ctx, cancel := context.WithTimeout(ctx, controlTimeout)
+	defer cancel()
+
+	_, err := bus.Request(ctx, topic, data)
+	return err
+}
+
+func sendEmail(bus *pubsub.Pubsub, logger *logging.Logger, subject string, body string) {
+	err := pubsub.Publish(bus, "email:send", pubsub.Email{Subject: subject, Body: body})
+	if err != nil {
+		logger.Error(fmt.Sprintf("rules: failed to send email (%s) - %v", subject, err))
+	}
+}
+
+// remember when a rule last acted. It waits until the time is in state, so the next run
+// of the rule can't read a stale value
+func recordLastAt(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, key string, at time.Time) {
+	value := homestate.TimeValue(at.UTC())
+	_, err := statebus.Apply(ctx, bus, homestate.Txn{
+		Writes: []homestate.Write{{Key: key, Value: &value}},
+	})
+	if err != nil {
+		logger.Error(fmt.Sprintf("rules: failed to record %s - %v", key, err))
+	}
+}
+
+// true if lastAt is a time before t. Anything else in a _last_at key is treated as a rule
+// that has never run
+func ranBefore(lastAt homestate.Value, t time.Time) bool {
+	at, err := lastAt.Time()
+	return err != nil || at.Before(t)
+}
+
+// claimRun records at in the _last_at key from previous before a rule acts, as long as the
+// key hasn't changed since the rule read it. If it has, another run of the rule got there
+// first and this one should do nothing
+func claimRun(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, previous homestate.Condition, at time.Time) bool {
+	value := homestate.TimeValue(at.UTC())
+	claimed, err := statebus.Apply(ctx, bus, homestate.Txn{
+		Conditions: []homestate.Condition{previous},
+		Writes:     []homestate.Write{{Key: previous.Key, Value: &value}},
+	})
+	if err != nil {
+		logger.Error(fmt.Sprintf("rules: failed to record %s - %v", previous.Key, err))
+		return false
+	}
+	if !claimed {
+		logger.Debug(fmt.Sprintf("rules: %s changed since it was read, not acting", previous.Key))
+	}
+	return claimed
+}
+
+// releaseRun puts back the _last_at value from before claimRun, so a rule that failed to
+// act can try again next time
+func releaseRun(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, previous homestate.Condition, at time.Time) {
+	value := homestate.TimeValue(at.UTC())
+	_, err := statebus.Apply(ctx, bus, homestate.Txn{
+		Conditions: []homestate.Condition{{Key: previous.Key, Value: &value}},
+		Writes:     []homestate.Write{{Key: previous.Key, Value: previous.Value}},
+	})
+	if err != nil {
+		logger.Error(fmt.Sprintf("rules: failed to reset %s - %v", previous.Key, err))
 	}
 }
@@ -2,6 +2,7 @@ package ruuvigateway
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
@@ -21,23 +22,34 @@ import (
 	"gitlab.com/jtaimisto/bluewalker/ruuvi"
 )
 
-func Init(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader, config *conf.ConfigSection) {
-	ip, err := config.GetString("ip")
-	if err != nil {
-		logger.Fatal("ruuvigateway: ip not found in config")
-		return
-	}
+// ruuvi tags run on batteries, and when they go flat we'd rather the readings disappear
+// than hang around looking current
+const readingTTL = 5 * time.Minute
 
-	addressMap, err := config.GetStringMap("names")
-	if err != nil {
-		logger.Fatal(fmt.Sprintf("ruuvigateway: names map not found in config - %v", err))
+type configData struct {
+	IP           string            `config:"ip,required"`
+	Names        map[string]string `config:"names,required"` // MAC address to name
+	PollInterval time.Duration     `config:"poll_interval" default:"20s"`
+}
+
+// ConfigSchema lists the keys Init reads from its config section
+var ConfigSchema = conf.SchemaFor(configData{})
+
+func Init(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader, configSection *conf.ConfigSection) {
+	var config configData
+	if err := configSection.Decode(&config); err != nil {
+		logger.Fatal(fmt.Sprintf("ruuvigateway: %v", err))
 		return
 	}
 
 	for {
-		time.Sleep(20 * time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(config.PollInterval):
+		}
 
-		fetchBleHistory(bus, logger, state, ip, addressMap)
+		fetchBleHistory(bus, logger, state, config.IP, config.Names)
 	}
 }
 
@@ -45,12 +57,12 @@ func fetchBleHistory(bus *pubsub.Pubsub, logger *logging.Logger, state homestate
 	ruuviGatewayHistoryUrl := fmt.Sprintf("http://%s/history", ip)
 
 	resp, err := http.Get(ruuviGatewayHistoryUrl)
-	defer resp.Body.Close()
-
 	if err != nil {
 		logger.Error(fmt.Sprintf("ruuvigateway: %v\n", err))
 		return
 	}
+	defer resp.Body.Close()
+
 	if resp.StatusCode != 200 {
 		logger.Error(fmt.Sprintf("ruuvigateway: unexpected response code %d\n", resp.StatusCode))
 		return
@@ -101,13 +113,13 @@ func fetchBleHistory(bus *pubsub.Pubsub, logger *logging.Logger, state homestate
 }
 
 func handleRuuviAd(bus *pubsub.Pubsub, logger *logging.Logger, ruuviName string, data *ruuvi.Data) {
-	tempSensor := entities.NewSensorGauge(bus, fmt.Sprintf("ruuvi.%s.temp_celcius", ruuviName))
-	humiditySensor := entities.NewSensorGauge(bus, fmt.Sprintf("ruuvi.%s.humidity", ruuviName))
-	pressureSensor := entities.NewSensorGauge(bus, fmt.Sprintf("ruuvi.%s.pressure", ruuviName))
-	voltageSensor := entities.NewSensorGauge(bus, fmt.Sprintf("ruuvi.%s.voltage", ruuviName))
-	txpowerSensor := entities.NewSensorGauge(bus, fmt.Sprintf("ruuvi.%s.txpower", ruuviName))
-	dewpointSensor := entities.NewSensorGauge(bus, fmt.Sprintf("ruuvi.%s.dewpoint_celcius", ruuviName))
-	absoluteHumiditySensor := entities.NewSensorGauge(bus, fmt.Sprintf("ruuvi.%s.absolute_humidity_g_per_m3", ruuviName))
+	tempSensor := entities.NewSensorGauge(bus, fmt.Sprintf("ruuvi.%s.temp_celcius", ruuviName), entities.WithTTL(readingTTL), entities.WithUnit("celsius"), entities.WithDeviceClass("temperature"))
+	humiditySensor := entities.NewSensorGauge(bus, fmt.Sprintf("ruuvi.%s.humidity", ruuviName), entities.WithTTL(readingTTL), entities.WithUnit("%"), entities.WithDeviceClass("humidity"))
+	pressureSensor := entities.NewSensorGauge(bus, fmt.Sprintf("ruuvi.%s.pressure", ruuviName), entities.WithTTL(readingTTL), entities.WithUnit("Pa"), entities.WithDeviceClass("pressure"))
+	voltageSensor := entities.NewSensorGauge(bus, fmt.Sprintf("ruuvi.%s.voltage", ruuviName), entities.WithTTL(readingTTL), entities.WithUnit("V"), entities.WithDeviceClass("voltage"))
+	txpowerSensor := entities.NewSensorGauge(bus, fmt.Sprintf("ruuvi.%s.txpower", ruuviName), entities.WithTTL(readingTTL), entities.WithUnit("dBm"), entities.WithDeviceClass("signal_strength"))
+	dewpointSensor := entities.NewSensorGauge(bus, fmt.Sprintf("ruuvi.%s.dewpoint_celcius", ruuviName), entities.WithTTL(readingTTL), entities.WithUnit("celsius"), entities.WithDeviceClass("temperature"))
+	absoluteHumiditySensor := entities.NewSensorGauge(bus, fmt.Sprintf("ruuvi.%s.absolute_humidity_g_per_m3", ruuviName), entities.WithTTL(readingTTL), entities.WithUnit("g/m3"), entities.WithDeviceClass("humidity"))
 
 	tempSensor.Update(float64(data.Temperature))
 	humiditySensor.Update(float64(data.Humidity))
@@ -1,6 +1,7 @@
 package unifi
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -18,22 +19,26 @@ var (
 )
 
 type configData struct {
-	address   string
-	unifiUser string
-	unifiPass string
-	unifiPort string
-	unifiSite string
-	ipMap     map[string]string
+	Address      string            `config:"address,required"`
+	User         string            `config:"user,required"`
+	Pass         string            `config:"pass,required"`
+	Port         string            `config:"port,required"`
+	Site         string            `config:"site,required"`
+	Names        map[string]string `config:"names,required"` // IP address to name
+	PollInterval time.Duration     `config:"poll_interval" default:"20s"`
 }
 
-func Init(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader, configSection *conf.ConfigSection) {
-	config, err := newConfigFromSection(configSection)
-	if err != nil {
+// ConfigSchema lists the keys Init reads from its config section
+var ConfigSchema = conf.SchemaFor(configData{})
+
+func Init(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader, configSection *conf.ConfigSection) {
+	var config configData
+	if err := configSection.Decode(&config); err != nil {
 		logger.Fatal(fmt.Sprintf("unifi: %v", err))
 		return
 	}
 
-	u, err := unifi.Login(config.unifiUser, config.unifiPass, config.address, config.unifiPort, config.unifiSite, unifiApiVersion)
+	u, err := unifi.Login(config.User, config.Pass, config.Address, config.Port, config.Site, unifiApiVersion)
 	if err != nil {
 		logger.Fatal(fmt.Sprintf("unifi: login returned error: %v", err))
 		return
@@ -41,12 +46,12 @@ func Init(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReade
 	defer u.Logout()
 
 	sensors := make(map[string]*entities.SensorTime)
-	for ip, name := range config.ipMap {
-		sensors[ip] = entities.NewSensorTime(bus, fmt.Sprintf("unifi.presence.last_seen.%s", name))
+	for ip, name := range config.Names {
+		sensors[ip] = entities.NewSensorTime(bus, fmt.Sprintf("unifi.presence.last_seen.%s", name), entities.WithDeviceClass("timestamp"))
 	}
 
 	for {
-		site, err := u.Site(config.unifiSite)
+		site, err := u.Site(config.Site)
 		if err != nil {
 			logger.Fatal(fmt.Sprintf("unifi: %v", err))
 			return
@@ -64,47 +69,10 @@ func Init(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReade
 			}
 		}
 
-		time.Sleep(20 * time.Second)
-	}
-}
-
-func newConfigFromSection(configSection *conf.ConfigSection) (configData, error) {
-	address, err := configSection.GetString("address")
-	if err != nil {
-		return configData{}, fmt.Errorf("address not found in config")
-	}
-
-	user, err := configSection.GetString("user")
-	if err != nil {
-		return configData{}, fmt.Errorf("user not found in config")
-	}
-
-	pass, err := configSection.GetString("pass")
-	if err != nil {
-		return configData{}, fmt.Errorf("pass not found in config")
-	}
-
-	port, err := configSection.GetString("port")
-	if err != nil {
-		return configData{}, fmt.Errorf("port not found in config")
-	}
-
-	site, err := configSection.GetString("site")
-	if err != nil {
-		return configData{}, fmt.Errorf("site not found in config")
-	}
-
-	names, err := configSection.GetStringMap("names")
-	if err != nil {
-		return configData{}, fmt.Errorf("names not found in config")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(config.PollInterval):
+		}
 	}
-
-	return configData{
-		address:   address,
-		unifiUser: user,
-		unifiPass: pass,
-		unifiPort: port,
-		unifiSite: site,
-		ipMap:     names,
-	}, nil
 }
@@ -0,0 +1,56 @@
+package busmetrics
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/yob/home-data/core/entities"
+	"github.com/yob/home-data/pubsub"
+)
+
+const interval = 60 * time.Second
+
+// Init copies the bus counters into state once a minute, so they can be sent to datadog
+// or used in rules like any other gauge. For each topic there's:
+//
+//	pubsub.<topic>.published
+//	pubsub.<topic>.delivered
+//	pubsub.<topic>.dropped
+//	pubsub.<topic>.subscribers
+//	pubsub.<topic>.max_channel_fill
+//
+// ":" in topic names is replaced with "_", so the state:update counters are stored in
+// pubsub.state_update.published and so on. The number of events waiting to be delivered
+// is stored in pubsub.publish_channel.length.
+func Init(ctx context.Context, bus *pubsub.Pubsub) {
+	sensors := make(map[string]*entities.SensorGauge)
+	update := func(key string, value float64) {
+		sensor, ok := sensors[key]
+		if !ok {
+			sensor = entities.NewSensorGauge(bus, key)
+			sensors[key] = sensor
+		}
+		sensor.Update(value)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		for _, stats := range bus.Stats() {
+			prefix := fmt.Sprintf("pubsub.%s", strings.ReplaceAll(stats.Topic, ":", "_"))
+			update(prefix+".published", float64(stats.Published))
+			update(prefix+".delivered", float64(stats.Delivered))
+			update(prefix+".dropped", float64(stats.Dropped))
+			update(prefix+".subscribers", float64(stats.Subscribers))
+			update(prefix+".max_channel_fill", float64(stats.MaxChannelFill))
+		}
+		length, _ := bus.PublishChanStats()
+		update("pubsub.publish_channel.length", float64(length))
+	}
+}
@@ -4,17 +4,24 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/pelletier/go-toml"
-	"github.com/pelletier/go-toml/query"
 )
 
 type ConfigFile struct {
-	tree *toml.Tree
+	tree    *toml.Tree
+	paths   []string
+	origins map[string]string
 }
 
 type ConfigSection struct {
+	name string
 	tree *toml.Tree
+	file *ConfigFile
 }
 
 func FindConfigPath() (string, error) {
@@ -38,17 +45,48 @@ func FindConfigPath() (string, error) {
 		return etcConfig, nil
 	}
 
-	return "", fmt.Errorf("Unable to find config file. Checked '%s' and '%s'", nextToBin, etcConfig)
+	return "", fmt.Errorf("Unable to find config file. Checked '%s' and '%s', use --config to choose another", nextToBin, etcConfig)
 }
 
+// NewConfigFromFile loads the config at path, along with any files it includes and the
+// files in conf.d (see loader), and resolves any references to environment variables or
+// secret files (see interpolateTree)
 func NewConfigFromFile(path string) (*ConfigFile, error) {
-	tree, err := toml.LoadFile(path)
+	files, err := loadFiles(path)
 	if err != nil {
 		return nil, err
 	}
-	return &ConfigFile{
-		tree: tree,
-	}, nil
+	file := &ConfigFile{
+		tree:    files.tree,
+		paths:   files.paths,
+		origins: files.origins,
+	}
+	if err := file.interpolateTree(file.tree, nil); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Paths returns every file the config was read from, starting with the main one
+func (file *ConfigFile) Paths() []string {
+	return file.paths
+}
+
+// origin returns the file that set a dotted key path like "unifi.pass". Anything that
+// wasn't set in a file, like a missing key, belongs to the closest table that was, and
+// finally to the main config file
+func (file *ConfigFile) origin(keyPath string) string {
+	for keyPath != "" {
+		if path, ok := file.origins[keyPath]; ok {
+			return path
+		}
+		idx := strings.LastIndex(keyPath, ".")
+		if idx < 0 {
+			break
+		}
+		keyPath = keyPath[:idx]
+	}
+	return file.paths[0]
 }
 
 func (file *ConfigFile) Section(name string) (*ConfigSection, error) {
@@ -58,36 +96,49 @@ func (file *ConfigFile) Section(name string) (*ConfigSection, error) {
 		return nil, fmt.Errorf("section '%s' not found", name)
 	}
 	return &ConfigSection{
+		name: name,
 		tree: subTree,
+		file: file,
 	}, nil
 }
 
+// AdapterSections returns every section with an adapter key, at any depth, ordered by
+// name
 func (file *ConfigFile) AdapterSections() []*ConfigSection {
+	return file.adapterSections(file.tree, nil)
+}
+
+func (file *ConfigFile) adapterSections(tree *toml.Tree, path []string) []*ConfigSection {
 	sections := make([]*ConfigSection, 0)
-	query, err := query.Compile("$..[?(adapterOnly)]")
-	if err != nil {
-		// TODO do something better than just printing out
-		fmt.Printf("err: %v", err)
-		return sections
+	if len(path) > 0 && tree.Has("adapter") {
+		sections = append(sections, &ConfigSection{name: strings.Join(path, "."), tree: tree, file: file})
 	}
 
-	query.SetFilter("adapterOnly", func(node interface{}) bool {
-		if tree, ok := node.(*toml.Tree); ok {
-			return tree.Has("adapter")
-		}
-		return false
-	})
-
-	results := query.Execute(file.tree)
-	for _, item := range results.Values() {
-		itemTree, ok := item.(*toml.Tree)
-		if ok {
-			sections = append(sections, &ConfigSection{tree: itemTree})
+	keys := tree.Keys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		if subTree, ok := tree.GetPath([]string{key}).(*toml.Tree); ok {
+			sections = append(sections, file.adapterSections(subTree, append(path, key))...)
 		}
 	}
 	return sections
 }
 
+// Name is the name of the section in the config file, like "daikin-study". Nested
+// sections have a dotted name
+func (section *ConfigSection) Name() string {
+	return section.name
+}
+
+// Origin returns the config file a key in the section was set in, or the file with the
+// section itself when key is "". Errors about the config should start with it
+func (section *ConfigSection) Origin(key string) string {
+	if key == "" {
+		return section.file.origin(section.name)
+	}
+	return section.file.origin(section.name + "." + key)
+}
+
 func (section *ConfigSection) GetString(key string) (string, error) {
 	value := section.tree.Get(key)
 	strValue, ok := value.(string)
@@ -146,6 +197,46 @@ func (section *ConfigSection) GetInt64(key string) (int64, error) {
 	return intValue, nil
 }
 
+func (section *ConfigSection) GetBool(key string) (bool, error) {
+	value := section.tree.Get(key)
+	boolValue, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("key '%s' is not a bool", key)
+	}
+	return boolValue, nil
+}
+
+// GetFloat also accepts whole numbers, nobody should have to write 20.0
+func (section *ConfigSection) GetFloat(key string) (float64, error) {
+	switch value := section.tree.Get(key).(type) {
+	case float64:
+		return value, nil
+	case int64:
+		return float64(value), nil
+	default:
+		return 0, fmt.Errorf("key '%s' is not a float", key)
+	}
+}
+
+// GetDuration parses a string like "90s" or "2h", see time.ParseDuration
+func (section *ConfigSection) GetDuration(key string) (time.Duration, error) {
+	strValue, err := section.GetString(key)
+	if err != nil {
+		return 0, fmt.Errorf("key '%s' is not a duration", key)
+	}
+	duration, err := time.ParseDuration(strValue)
+	if err != nil {
+		return 0, fmt.Errorf("key '%s' is not a duration: %v", key, err)
+	}
+	return duration, nil
+}
+
+// Equal reports whether two sections have the same keys and values, so an adapter only
+// needs to be restarted when its section has really changed
+func (section *ConfigSection) Equal(other *ConfigSection) bool {
+	return reflect.DeepEqual(section.tree.ToMap(), other.tree.ToMap())
+}
+
 func (section *ConfigSection) String() string {
 	return section.tree.String()
 }
@@ -0,0 +1,216 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Decode copies the section into the struct that v points to. Fields are matched to keys
+// with a config tag, which can be followed by ",required". A default tag is used when the
+// key is missing:
+//
+//	type configData struct {
+//		Name         string        `config:"name,required"`
+//		Token        string        `config:"token"`
+//		PollInterval time.Duration `config:"poll_interval" default:"20s"`
+//	}
+//
+// The fields can be a string, int, int64, float64, bool, time.Duration (written as a
+// string like "20s"), []string or map[string]string. Fields without a config tag are left
+// alone. Every problem is returned, with the file, section and key it's about.
+func (section *ConfigSection) Decode(v any) error {
+	target := reflect.ValueOf(v)
+	if target.Kind() != reflect.Pointer || target.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config: Decode needs a pointer to a struct, not %T", v)
+	}
+	target = target.Elem()
+
+	fields, err := taggedFields(target.Type())
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, 0)
+	for _, field := range fields {
+		if err := section.decodeField(field, target.FieldByIndex(field.index)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (section *ConfigSection) decodeField(field taggedField, target reflect.Value) error {
+	key := field.key
+	if section.tree.GetPath([]string{key.Name}) == nil {
+		switch {
+		case field.defaultValue != "":
+			if err := setFromString(target, key.Type, field.defaultValue); err != nil {
+				return fmt.Errorf("%s: section '%s', key '%s': invalid default - %v", section.Origin(""), section.name, key.Name, err)
+			}
+			return nil
+		case key.Required:
+			return fmt.Errorf("%s: section '%s': missing required key '%s'", section.Origin(""), section.name, key.Name)
+		}
+		return nil
+	}
+	if err := checkType(key.Type, section.tree.GetPath([]string{key.Name})); err != nil {
+		return fmt.Errorf("%s: section '%s', key '%s': %v", section.Origin(key.Name), section.name, key.Name, err)
+	}
+
+	var value any
+	var err error
+	switch key.Type {
+	case TypeString:
+		value, err = section.GetString(key.Name)
+	case TypeInt:
+		value, err = section.GetInt64(key.Name)
+	case TypeFloat:
+		value, err = section.GetFloat(key.Name)
+	case TypeBool:
+		value, err = section.GetBool(key.Name)
+	case TypeDuration:
+		value, err = section.GetDuration(key.Name)
+	case TypeStringSlice:
+		value, err = section.GetStringSlice(key.Name)
+	case TypeStringMap:
+		value, err = section.GetStringMap(key.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: section '%s': %v", section.Origin(key.Name), section.name, err)
+	}
+	if target.Kind() == reflect.Int && target.OverflowInt(value.(int64)) {
+		return fmt.Errorf("%s: section '%s', key '%s': %d is too big", section.Origin(key.Name), section.name, key.Name, value)
+	}
+	target.Set(reflect.ValueOf(value).Convert(target.Type()))
+	return nil
+}
+
+// SchemaFor returns the schema for a struct that's used with Decode, so the schema and the
+// fields can't disagree. It panics if the struct has a field Decode can't fill in, which
+// is a bug that should be found the first time the program runs
+func SchemaFor(v any) Schema {
+	fields, err := taggedFields(reflect.TypeOf(v))
+	if err != nil {
+		panic(err)
+	}
+
+	schema := make(Schema, 0, len(fields))
+	for _, field := range fields {
+		key := field.key
+		if field.defaultValue != "" {
+			value, err := tomlValue(key.Type, field.defaultValue)
+			if err != nil {
+				panic(fmt.Sprintf("config: invalid default for %s - %v", key.Name, err))
+			}
+			key.Default = value
+		}
+		schema = append(schema, key)
+	}
+	return schema
+}
+
+type taggedField struct {
+	key          Key
+	defaultValue string
+	index        []int
+}
+
+var (
+	durationType  = reflect.TypeFor[time.Duration]()
+	stringSlice   = reflect.TypeFor[[]string]()
+	stringMapType = reflect.TypeFor[map[string]string]()
+)
+
+func taggedFields(structType reflect.Type) ([]taggedField, error) {
+	if structType.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("config: %s is not a struct", structType)
+	}
+
+	fields := make([]taggedField, 0)
+	for _, field := range reflect.VisibleFields(structType) {
+		tag, ok := field.Tag.Lookup("config")
+		if !ok {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+
+		keyType, err := typeFor(field.Type)
+		if err != nil {
+			return nil, fmt.Errorf("config: field %s - %v", field.Name, err)
+		}
+		if !field.IsExported() {
+			return nil, fmt.Errorf("config: field %s must be exported to be decoded", field.Name)
+		}
+
+		fields = append(fields, taggedField{
+			key: Key{
+				Name:     name,
+				Type:     keyType,
+				Required: options == "required",
+			},
+			defaultValue: field.Tag.Get("default"),
+			index:        field.Index,
+		})
+	}
+	return fields, nil
+}
+
+func typeFor(fieldType reflect.Type) (Type, error) {
+	switch {
+	case fieldType == durationType:
+		return TypeDuration, nil
+	case fieldType == stringSlice:
+		return TypeStringSlice, nil
+	case fieldType == stringMapType:
+		return TypeStringMap, nil
+	}
+	switch fieldType.Kind() {
+	case reflect.String:
+		return TypeString, nil
+	case reflect.Int, reflect.Int64:
+		return TypeInt, nil
+	case reflect.Float64:
+		return TypeFloat, nil
+	case reflect.Bool:
+		return TypeBool, nil
+	default:
+		return 0, fmt.Errorf("%s can't be decoded", fieldType)
+	}
+}
+
+// converts a default from a struct tag into the value go-toml would have loaded
+func tomlValue(t Type, str string) (any, error) {
+	switch t {
+	case TypeString:
+		return str, nil
+	case TypeInt:
+		return strconv.ParseInt(str, 10, 64)
+	case TypeFloat:
+		return strconv.ParseFloat(str, 64)
+	case TypeBool:
+		return strconv.ParseBool(str)
+	case TypeDuration:
+		if _, err := time.ParseDuration(str); err != nil {
+			return nil, err
+		}
+		return str, nil
+	default:
+		return nil, fmt.Errorf("%s can't have a default", t)
+	}
+}
+
+func setFromString(target reflect.Value, t Type, str string) error {
+	value, err := tomlValue(t, str)
+	if err != nil {
+		return err
+	}
+	if t == TypeDuration {
+		value, _ = time.ParseDuration(str)
+	}
+	target.Set(reflect.ValueOf(value).Convert(target.Type()))
+	return nil
+}
@@ -0,0 +1,188 @@
+package config
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type decodeTest struct {
+	Name         string            `config:"name,required"`
+	Token        string            `config:"token"`
+	Port         int               `config:"port" default:"8080"`
+	Limit        int64             `config:"limit"`
+	Ratio        float64           `config:"ratio" default:"0.5"`
+	Enabled      bool              `config:"enabled" default:"true"`
+	PollInterval time.Duration     `config:"poll_interval" default:"20s"`
+	Hosts        []string          `config:"hosts"`
+	Names        map[string]string `config:"names"`
+	Untagged     string
+}
+
+func decodeSection(t *testing.T, files map[string]string) (*ConfigSection, string) {
+	t.Helper()
+	dir := writeFiles(t, files)
+	configFile, err := NewConfigFromFile(filepath.Join(dir, "config.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	section, err := configFile.Section("device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return section, dir
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		want     decodeTest
+	}{
+		{
+			name:     "defaults",
+			contents: "name = \"study\"\n",
+			want: decodeTest{
+				Name: "study", Port: 8080, Ratio: 0.5, Enabled: true, PollInterval: 20 * time.Second,
+				Untagged: "untouched",
+			},
+		},
+		{
+			name: "everything set",
+			contents: `
+name = "study"
+token = "abc"
+port = 80
+limit = 9000000000
+ratio = 1.5
+enabled = false
+poll_interval = "2m"
+hosts = ["a", "b"]
+[device.names]
+"192.168.1.2" = "phone"
+`,
+			want: decodeTest{
+				Name: "study", Token: "abc", Port: 80, Limit: 9000000000, Ratio: 1.5, Enabled: false,
+				PollInterval: 2 * time.Minute, Hosts: []string{"a", "b"},
+				Names: map[string]string{"192.168.1.2": "phone"}, Untagged: "untouched",
+			},
+		},
+		{
+			name:     "a float can be written as an int",
+			contents: "name = \"study\"\nratio = 2\n",
+			want: decodeTest{
+				Name: "study", Port: 8080, Ratio: 2, Enabled: true, PollInterval: 20 * time.Second,
+				Untagged: "untouched",
+			},
+		},
+	}
+	for _, test := range tests {
+		section, _ := decodeSection(t, map[string]string{"config.toml": "[device]\n" + test.contents})
+		got := decodeTest{Untagged: "untouched"}
+		if err := section.Decode(&got); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  []string // with the directory as {dir}
+	}{
+		{
+			name:  "missing required key",
+			files: map[string]string{"config.toml": "[device]\ntoken = \"abc\"\n"},
+			want:  []string{"{dir}/config.toml: section 'device': missing required key 'name'"},
+		},
+		{
+			name:  "wrong types",
+			files: map[string]string{"config.toml": "[device]\nname = 1\nport = \"80\"\nhosts = [1, 2]\n"},
+			want: []string{
+				"{dir}/config.toml: section 'device', key 'name': should be a string, not an int",
+				"{dir}/config.toml: section 'device', key 'port': should be a int, not a string",
+				"{dir}/config.toml: section 'device', key 'hosts': should be a array of strings",
+			},
+		},
+		{
+			name:  "an invalid duration",
+			files: map[string]string{"config.toml": "[device]\nname = \"study\"\npoll_interval = \"soon\"\n"},
+			want:  []string{"{dir}/config.toml: section 'device', key 'poll_interval': 'soon' is not a duration"},
+		},
+		{
+			name: "the error names the file the key is in",
+			files: map[string]string{
+				"config.toml":        "[device]\nname = \"study\"\n",
+				"conf.d/device.toml": "[device]\nport = true\n",
+			},
+			want: []string{"{dir}/conf.d/device.toml: section 'device', key 'port': should be a int, not a bool"},
+		},
+		{
+			name: "a missing key is reported against the file with the section",
+			files: map[string]string{
+				"config.toml": "include = \"device.toml\"\n",
+				"device.toml": "[device]\ntoken = \"abc\"\n",
+			},
+			want: []string{"{dir}/device.toml: section 'device': missing required key 'name'"},
+		},
+	}
+	for _, test := range tests {
+		section, dir := decodeSection(t, test.files)
+		err := section.Decode(&decodeTest{})
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+			continue
+		}
+		got := strings.Split(err.Error(), "\n")
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got errors %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for idx, want := range test.want {
+			want = strings.ReplaceAll(want, "{dir}", dir)
+			if !strings.HasPrefix(got[idx], want) {
+				t.Errorf("%s: error = %s, want %s", test.name, got[idx], want)
+			}
+		}
+	}
+}
+
+func TestDecodeInvalidTarget(t *testing.T) {
+	section, _ := decodeSection(t, map[string]string{"config.toml": "[device]\nname = \"study\"\n"})
+	var unsupported struct {
+		Port uint `config:"port"`
+	}
+	for _, target := range []any{decodeTest{}, new(string), &unsupported} {
+		if err := section.Decode(target); err == nil {
+			t.Errorf("expected an error decoding into %T", target)
+		}
+	}
+}
+
+func TestSchemaFor(t *testing.T) {
+	schema := SchemaFor(decodeTest{})
+	byName := make(map[string]Key)
+	for _, key := range schema {
+		byName[key.Name] = key
+	}
+	if len(schema) != 9 {
+		t.Errorf("expected a key for each tagged field, got %v", schema)
+	}
+	if key := byName["name"]; !key.Required || key.Type != TypeString {
+		t.Errorf("unexpected name key %+v", key)
+	}
+	// defaults are the values go-toml would have loaded
+	if key := byName["port"]; key.Default != int64(8080) {
+		t.Errorf("port default = %#v", key.Default)
+	}
+	if key := byName["poll_interval"]; key.Default != "20s" || key.Type != TypeDuration {
+		t.Errorf("unexpected poll_interval key %+v", key)
+	}
+}
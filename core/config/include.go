@@ -0,0 +1,180 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+// The config doesn't have to be in one file. Any file can pull in others with a top level
+// include, which takes a path or a list of them. Relative paths are relative to the file
+// doing the including, and globs are allowed:
+//
+//	include = ["secrets.toml", "devices/*.toml"]
+//
+// Every .toml file in a conf.d directory next to the main config file is read too, in
+// order of name. That way each device can have its own file, and secrets can live in a
+// file with tighter permissions.
+//
+// The files are merged into one tree. Tables with the same name are combined, so
+// [unifi] can be in one file and its password in another, but a key can only be set once.
+// Each file is only read once, however many times it's included.
+type loader struct {
+	tree    *toml.Tree
+	paths   []string          // every file read, in order
+	origins map[string]string // the file each table and key was first set in, by dotted path
+	seen    map[string]bool
+}
+
+func loadFiles(path string) (*loader, error) {
+	l := &loader{
+		origins: make(map[string]string),
+		seen:    make(map[string]bool),
+	}
+	if err := l.load(path); err != nil {
+		return nil, err
+	}
+
+	confFiles, err := filepath.Glob(filepath.Join(filepath.Dir(path), "conf.d", "*.toml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(confFiles)
+	for _, confFile := range confFiles {
+		if err := l.load(confFile); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *loader) load(path string) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if l.seen[absPath] {
+		return nil
+	}
+	l.seen[absPath] = true
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	tree, err := toml.LoadBytes(contents)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	l.paths = append(l.paths, path)
+
+	includes, err := includePaths(tree, path)
+	if err != nil {
+		return err
+	}
+	// include is only for us, adapters and validation never see it
+	if tree.Has("include") {
+		if err := tree.Delete("include"); err != nil {
+			return err
+		}
+	}
+
+	l.recordOrigins(tree, nil, path)
+
+	if l.tree == nil {
+		l.tree = tree
+	} else if err := mergeTree(l.tree, tree, nil); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	for _, include := range includes {
+		if err := l.load(include); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func includePaths(tree *toml.Tree, path string) ([]string, error) {
+	var patterns []string
+	switch value := tree.Get("include").(type) {
+	case nil:
+		return nil, nil
+	case string:
+		patterns = []string{value}
+	case []interface{}:
+		for _, item := range value {
+			str, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: include should be a string or an array of strings", path)
+			}
+			patterns = append(patterns, str)
+		}
+	default:
+		return nil, fmt.Errorf("%s: include should be a string or an array of strings", path)
+	}
+
+	paths := make([]string, 0)
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid include '%s' - %v", path, pattern, err)
+		}
+		// a glob can match nothing, like an empty directory, but a plain path is a typo
+		// or a missing file
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return nil, fmt.Errorf("%s: included file %s not found", path, pattern)
+		}
+		sort.Strings(matches)
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// remember which file each table and key came from, so errors can name it. A table that's
+// split across files belongs to the first one
+func (l *loader) recordOrigins(tree *toml.Tree, prefix []string, path string) {
+	for _, key := range tree.Keys() {
+		keyPath := append(append([]string{}, prefix...), key)
+		name := strings.Join(keyPath, ".")
+		if _, ok := l.origins[name]; !ok {
+			l.origins[name] = path
+		}
+		if subTree, ok := tree.GetPath([]string{key}).(*toml.Tree); ok {
+			l.recordOrigins(subTree, keyPath, path)
+		}
+	}
+}
+
+// copy everything in src into dst, combining tables that are in both
+func mergeTree(dst *toml.Tree, src *toml.Tree, path []string) error {
+	keys := src.Keys()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		keyPath := append(append([]string{}, path...), key)
+		srcValue := src.GetPath([]string{key})
+		dstValue := dst.GetPath([]string{key})
+		if dstValue == nil {
+			dst.SetPath([]string{key}, srcValue)
+			continue
+		}
+
+		dstTree, dstIsTree := dstValue.(*toml.Tree)
+		srcTree, srcIsTree := srcValue.(*toml.Tree)
+		if !dstIsTree || !srcIsTree {
+			return fmt.Errorf("key '%s' is already set in another config file", strings.Join(keyPath, "."))
+		}
+		if err := mergeTree(dstTree, srcTree, keyPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writes the files into a new directory, creating any directories they're in
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestIncludes(t *testing.T) {
+	tests := []struct {
+		name   string
+		files  map[string]string
+		values map[string]string // section.key to the value it should have
+		paths  []string          // the files read, in order
+	}{
+		{
+			name: "a single include",
+			files: map[string]string{
+				"config.toml":  "include = \"secrets.toml\"\n[unifi]\nadapter = \"unifi\"\n",
+				"secrets.toml": "[unifi]\npass = \"secret\"\n",
+			},
+			values: map[string]string{"unifi.adapter": "unifi", "unifi.pass": "secret"},
+			paths:  []string{"config.toml", "secrets.toml"},
+		},
+		{
+			name: "a list of includes and globs",
+			files: map[string]string{
+				"config.toml":          "include = [\"secrets.toml\", \"devices/*.toml\", \"empty/*.toml\"]\n",
+				"secrets.toml":         "[unifi]\npass = \"secret\"\n",
+				"devices/kitchen.toml": "[kitchen]\nadapter = \"ruuvi\"\n",
+				"devices/study.toml":   "[study]\nadapter = \"daikin\"\n",
+			},
+			values: map[string]string{"unifi.pass": "secret", "kitchen.adapter": "ruuvi", "study.adapter": "daikin"},
+			paths:  []string{"config.toml", "secrets.toml", "devices/kitchen.toml", "devices/study.toml"},
+		},
+		{
+			name: "conf.d is read in order of name, after the includes",
+			files: map[string]string{
+				"config.toml":       "include = \"secrets.toml\"\n",
+				"secrets.toml":      "[unifi]\npass = \"secret\"\n",
+				"conf.d/b.toml":     "[b]\nadapter = \"kasa\"\n",
+				"conf.d/a.toml":     "[a]\nadapter = \"kasa\"\n",
+				"conf.d/notes.txt":  "not toml",
+				"conf.d/c.toml.bak": "[c]\nadapter = \"kasa\"\n",
+			},
+			values: map[string]string{"a.adapter": "kasa", "b.adapter": "kasa", "unifi.pass": "secret"},
+			paths:  []string{"config.toml", "secrets.toml", "conf.d/a.toml", "conf.d/b.toml"},
+		},
+		{
+			name: "each file is only read once",
+			files: map[string]string{
+				"config.toml":  "include = [\"secrets.toml\", \"./secrets.toml\", \"other.toml\"]\n",
+				"other.toml":   "include = [\"secrets.toml\", \"config.toml\"]\n[other]\nadapter = \"kasa\"\n",
+				"secrets.toml": "[unifi]\npass = \"secret\"\n",
+			},
+			values: map[string]string{"unifi.pass": "secret", "other.adapter": "kasa"},
+			paths:  []string{"config.toml", "secrets.toml", "other.toml"},
+		},
+		{
+			name: "nested tables are combined",
+			files: map[string]string{
+				"config.toml": "include = \"names.toml\"\n[unifi]\nadapter = \"unifi\"\n[unifi.names]\n\"192.168.1.2\" = \"phone\"\n",
+				"names.toml":  "[unifi.names]\n\"192.168.1.3\" = \"laptop\"\n",
+			},
+			values: map[string]string{"unifi.adapter": "unifi"},
+			paths:  []string{"config.toml", "names.toml"},
+		},
+	}
+	for _, test := range tests {
+		dir := writeFiles(t, test.files)
+		configFile, err := NewConfigFromFile(filepath.Join(dir, "config.toml"))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		for path, want := range test.values {
+			name, key, _ := strings.Cut(path, ".")
+			section, err := configFile.Section(name)
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+				continue
+			}
+			if got, err := section.GetString(key); got != want {
+				t.Errorf("%s: %s = %q %v, want %q", test.name, path, got, err, want)
+			}
+		}
+		paths := make([]string, 0, len(test.paths))
+		for _, path := range test.paths {
+			paths = append(paths, filepath.Join(dir, path))
+		}
+		if got := configFile.Paths(); !slices.Equal(got, paths) {
+			t.Errorf("%s: Paths() = %v, want %v", test.name, got, paths)
+		}
+	}
+
+	// the tables split across files are combined
+	dir := writeFiles(t, tests[4].files)
+	configFile, _ := NewConfigFromFile(filepath.Join(dir, "config.toml"))
+	section, _ := configFile.Section("unifi")
+	names, _ := section.GetStringMap("names")
+	if len(names) != 2 || names["192.168.1.2"] != "phone" || names["192.168.1.3"] != "laptop" {
+		t.Errorf("names = %v", names)
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string // with the directory as {dir}
+	}{
+		{
+			name: "a missing include",
+			files: map[string]string{
+				"config.toml": "include = \"secrets.toml\"\n",
+			},
+			want: "{dir}/config.toml: included file {dir}/secrets.toml not found",
+		},
+		{
+			name: "include isn't a string",
+			files: map[string]string{
+				"config.toml": "include = 1\n",
+			},
+			want: "{dir}/config.toml: include should be a string or an array of strings",
+		},
+		{
+			name: "include has something other than strings",
+			files: map[string]string{
+				"config.toml": "include = [\"secrets.toml\", 1]\n",
+			},
+			want: "{dir}/config.toml: include should be a string or an array of strings",
+		},
+		{
+			name: "a key is set in two files",
+			files: map[string]string{
+				"config.toml":  "include = \"secrets.toml\"\n[unifi]\npass = \"one\"\n",
+				"secrets.toml": "[unifi]\npass = \"two\"\n",
+			},
+			want: "{dir}/secrets.toml: key 'unifi.pass' is already set in another config file",
+		},
+		{
+			name: "a key in conf.d can't override the main file",
+			files: map[string]string{
+				"config.toml":       "[unifi]\npass = \"one\"\n",
+				"conf.d/unifi.toml": "[unifi]\npass = \"two\"\n",
+			},
+			want: "{dir}/conf.d/unifi.toml: key 'unifi.pass' is already set in another config file",
+		},
+		{
+			name: "a table is replaced by a value",
+			files: map[string]string{
+				"config.toml": "include = \"other.toml\"\n[unifi]\nadapter = \"unifi\"\n",
+				"other.toml":  "unifi = \"nope\"\n",
+			},
+			want: "{dir}/other.toml: key 'unifi' is already set in another config file",
+		},
+		{
+			name: "invalid toml in an include",
+			files: map[string]string{
+				"config.toml": "include = \"broken.toml\"\n",
+				"broken.toml": "[unifi\n",
+			},
+			want: "{dir}/broken.toml: ",
+		},
+	}
+	for _, test := range tests {
+		dir := writeFiles(t, test.files)
+		_, err := NewConfigFromFile(filepath.Join(dir, "config.toml"))
+		want := strings.ReplaceAll(test.want, "{dir}", dir)
+		if err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("%s: error = %v, want %s", test.name, err, want)
+		}
+	}
+}
+
+func TestUnreadableInclude(t *testing.T) {
+	// a directory can't be read as a file, even by root
+	dir := writeFiles(t, map[string]string{
+		"config.toml":              "include = \"secrets.toml\"\n",
+		"secrets.toml/placeholder": "",
+	})
+	_, err := NewConfigFromFile(filepath.Join(dir, "config.toml"))
+	if err == nil || !strings.Contains(err.Error(), filepath.Join(dir, "secrets.toml")) {
+		t.Errorf("expected an error naming secrets.toml, got %v", err)
+	}
+}
+
+func TestOrigin(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"config.toml":      "include = \"secrets.toml\"\n[unifi]\nadapter = \"unifi\"\n",
+		"secrets.toml":     "[unifi]\npass = \"secret\"\n",
+		"conf.d/kasa.toml": "[kasa]\nadapter = \"kasa\"\n",
+	})
+	configFile, err := NewConfigFromFile(filepath.Join(dir, "config.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unifi, _ := configFile.Section("unifi")
+	kasa, _ := configFile.Section("kasa")
+	tests := []struct {
+		section *ConfigSection
+		key     string
+		want    string
+	}{
+		{unifi, "", "config.toml"},
+		{unifi, "adapter", "config.toml"},
+		{unifi, "pass", "secrets.toml"},
+		// a missing key belongs to the file the table is in
+		{unifi, "site", "config.toml"},
+		{kasa, "", "conf.d/kasa.toml"},
+		{kasa, "adapter", "conf.d/kasa.toml"},
+		{kasa, "host", "conf.d/kasa.toml"},
+	}
+	for _, test := range tests {
+		if got := test.section.Origin(test.key); got != filepath.Join(dir, test.want) {
+			t.Errorf("%s.Origin(%s) = %s, want %s", test.section.Name(), test.key, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+// Secrets don't need to be in the config file. Any string value can reference an
+// environment variable, and the whole value can be read from a file:
+//
+//	password = "${UNIFI_PASS}"
+//	token = "file:/etc/home-data/daikin-study-token"
+//	token = "file:${CREDENTIALS_DIRECTORY}/daikin-study-token"
+//
+// Variables are replaced first, so they can be used in file paths. "$$" is a literal "$".
+// Files have any trailing newlines removed. References are resolved once, when the file
+// is loaded, and a missing variable or unreadable file is an error.
+func (file *ConfigFile) interpolateTree(tree *toml.Tree, path []string) error {
+	keys := tree.Keys()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		switch value := tree.GetPath([]string{key}).(type) {
+		case *toml.Tree:
+			if err := file.interpolateTree(value, append(path, key)); err != nil {
+				return err
+			}
+		case []*toml.Tree:
+			for _, subTree := range value {
+				if err := file.interpolateTree(subTree, append(path, key)); err != nil {
+					return err
+				}
+			}
+		case string:
+			resolved, err := interpolate(value)
+			if err != nil {
+				return file.keyError(path, key, err)
+			}
+			tree.SetPath([]string{key}, resolved)
+		case []interface{}:
+			changed := false
+			for idx, item := range value {
+				if str, ok := item.(string); ok {
+					resolved, err := interpolate(str)
+					if err != nil {
+						return file.keyError(path, key, err)
+					}
+					value[idx] = resolved
+					changed = true
+				}
+			}
+			if changed {
+				tree.SetPath([]string{key}, value)
+			}
+		}
+	}
+	return nil
+}
+
+func interpolate(value string) (string, error) {
+	resolved, err := expandVars(value)
+	if err != nil {
+		return "", err
+	}
+
+	filePath, ok := strings.CutPrefix(resolved, "file:")
+	if !ok {
+		return resolved, nil
+	}
+	contents, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", fmt.Errorf("unable to read %s: %v", filePath, err)
+	}
+	return strings.TrimRight(string(contents), "\r\n"), nil
+}
+
+// replace ${NAME} with the value of the environment variable NAME
+func expandVars(value string) (string, error) {
+	var result strings.Builder
+	rest := value
+	for {
+		idx := strings.IndexByte(rest, '$')
+		if idx < 0 || idx == len(rest)-1 {
+			result.WriteString(rest)
+			return result.String(), nil
+		}
+		result.WriteString(rest[:idx])
+
+		switch rest[idx+1] {
+		case '$':
+			result.WriteByte('$')
+			rest = rest[idx+2:]
+		case '{':
+			end := strings.IndexByte(rest[idx:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated ${ in '%s'", value)
+			}
+			name := rest[idx+2 : idx+end]
+			if name == "" {
+				return "", fmt.Errorf("empty ${} in '%s'", value)
+			}
+			envValue, ok := os.LookupEnv(name)
+			if !ok {
+				return "", fmt.Errorf("environment variable %s is not set", name)
+			}
+			result.WriteString(envValue)
+			rest = rest[idx+end+1:]
+		default:
+			// a lone $ is left alone
+			result.WriteByte('$')
+			rest = rest[idx+1:]
+		}
+	}
+}
+
+func (file *ConfigFile) keyError(path []string, key string, err error) error {
+	keyPath := append(append([]string{}, path...), key)
+	origin := file.origin(strings.Join(keyPath, "."))
+	if len(path) == 0 {
+		return fmt.Errorf("%s: key '%s': %v", origin, key, err)
+	}
+	return fmt.Errorf("%s: section '%s', key '%s': %v", origin, strings.Join(path, "."), key, err)
+}
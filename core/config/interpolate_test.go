@@ -0,0 +1,95 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "token"), []byte("from-a-file\r\n\n"), 0600)
+	t.Setenv("HOME_DATA_TEST_PASS", "secret")
+	t.Setenv("HOME_DATA_TEST_DIR", dir)
+
+	tests := []struct {
+		value string
+		want  string
+		err   string
+	}{
+		{value: "plain", want: "plain"},
+		{value: "${HOME_DATA_TEST_PASS}", want: "secret"},
+		{value: "a-${HOME_DATA_TEST_PASS}-${HOME_DATA_TEST_PASS}", want: "a-secret-secret"},
+		{value: "$${HOME_DATA_TEST_PASS}", want: "${HOME_DATA_TEST_PASS}"},
+		{value: "costs $5", want: "costs $5"},
+		{value: "ends with $", want: "ends with $"},
+		{value: "file:" + filepath.Join(dir, "token"), want: "from-a-file"},
+		{value: "file:${HOME_DATA_TEST_DIR}/token", want: "from-a-file"},
+		// only a whole value is read from a file
+		{value: "see file:/etc/passwd", want: "see file:/etc/passwd"},
+
+		{value: "${HOME_DATA_TEST_MISSING}", err: "environment variable HOME_DATA_TEST_MISSING is not set"},
+		{value: "${HOME_DATA_TEST_PASS", err: "unterminated ${ in '${HOME_DATA_TEST_PASS'"},
+		{value: "${}", err: "empty ${} in '${}'"},
+		{value: "file:" + filepath.Join(dir, "missing"), err: "unable to read " + filepath.Join(dir, "missing")},
+		{value: "file:" + dir, err: "unable to read " + dir},
+	}
+	for _, test := range tests {
+		got, err := interpolate(test.value)
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("interpolate(%s) error = %v, want %s", test.value, err, test.err)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("interpolate(%s) = %q, %v, want %q", test.value, got, err, test.want)
+		}
+	}
+}
+
+func TestInterpolateConfigFile(t *testing.T) {
+	t.Setenv("HOME_DATA_TEST_PASS", "secret")
+	t.Setenv("HOME_DATA_TEST_SITE", "default")
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.toml")
+	os.WriteFile(path, []byte(`
+include = "secrets.toml"
+
+[unifi]
+adapter = "unifi"
+site = "${HOME_DATA_TEST_SITE}"
+macs = ["${HOME_DATA_TEST_SITE}", "plain"]
+
+[unifi.names]
+"192.168.1.2" = "${HOME_DATA_TEST_PASS}"
+`), 0644)
+	os.WriteFile(filepath.Join(dir, "secrets.toml"), []byte("[unifi]\npass = \"${HOME_DATA_TEST_PASS}\"\n"), 0600)
+
+	configFile, err := NewConfigFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	section, _ := configFile.Section("unifi")
+	for key, want := range map[string]string{"site": "default", "pass": "secret"} {
+		if got, _ := section.GetString(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+	if got, _ := section.GetStringSlice("macs"); len(got) != 2 || got[0] != "default" || got[1] != "plain" {
+		t.Errorf("macs = %v", got)
+	}
+	if got, _ := section.GetStringMap("names"); got["192.168.1.2"] != "secret" {
+		t.Errorf("names = %v", got)
+	}
+
+	// the error names the file the reference is in
+	os.WriteFile(filepath.Join(dir, "secrets.toml"), []byte("[unifi]\npass = \"${HOME_DATA_TEST_MISSING}\"\n"), 0600)
+	_, err = NewConfigFromFile(path)
+	want := filepath.Join(dir, "secrets.toml") + ": section 'unifi', key 'pass': environment variable HOME_DATA_TEST_MISSING is not set"
+	if err == nil || err.Error() != want {
+		t.Errorf("error = %v, want %s", err, want)
+	}
+}
@@ -0,0 +1,214 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml"
+)
+
+// Type is the type of value a config key holds
+type Type int
+
+const (
+	TypeString Type = iota
+	TypeInt
+	TypeFloat // whole numbers are allowed too
+	TypeBool
+	TypeDuration // a string like "90s" or "2h"
+	TypeStringSlice
+	TypeStringMap // a table of strings, like [ruuvi.names]
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeString:
+		return "string"
+	case TypeInt:
+		return "int"
+	case TypeFloat:
+		return "float"
+	case TypeBool:
+		return "bool"
+	case TypeDuration:
+		return "duration"
+	case TypeStringSlice:
+		return "array of strings"
+	case TypeStringMap:
+		return "table of strings"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(t))
+	}
+}
+
+// Key describes a single key in a config section
+type Key struct {
+	Name     string
+	Type     Type
+	Required bool
+
+	// used when the key isn't in the config file. It must be the type go-toml would
+	// load for the key: a string, int64, float64, bool, or []interface{} of strings
+	Default any
+}
+
+// Schema lists every key a section can have. Each adapter declares one, so mistakes in
+// the config are found before anything starts
+type Schema []Key
+
+// keys that are allowed in every adapter section, whatever the schema says
+var adapterKeys = map[string]bool{
+	"adapter": true,
+	"name":    true, // used to tell adapters of the same type apart, see adapterSource in core/supervisor
+}
+
+// Validate checks the core section against coreSchema, and each adapter section against
+// the schema for its adapter. Every problem is returned, not just the first.
+//
+// Missing keys that have a default are set to it, so validate the file before using it.
+func (file *ConfigFile) Validate(coreSchema Schema, adapterSchemas map[string]Schema) []error {
+	errs := make([]error, 0)
+
+	core, err := file.Section("core")
+	if err != nil {
+		errs = append(errs, fmt.Errorf("%s: %v", file.paths[0], err))
+	} else {
+		errs = append(errs, core.validate(coreSchema, nil)...)
+	}
+
+	for _, section := range file.AdapterSections() {
+		adapterName, err := section.GetString("adapter")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: section '%s': adapter should be a string", section.Origin("adapter"), section.name))
+			continue
+		}
+		schema, ok := adapterSchemas[adapterName]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: section '%s': adapter '%s' not recognised", section.Origin("adapter"), section.name, adapterName))
+			continue
+		}
+		errs = append(errs, section.validate(schema, adapterKeys)...)
+	}
+
+	// a table without an adapter key (or any inside it) is ignored, which is almost
+	// certainly a mistake
+	keys := file.tree.Keys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		subTree, ok := file.tree.GetPath([]string{key}).(*toml.Tree)
+		if ok && key != "core" && len(file.adapterSections(subTree, []string{key})) == 0 {
+			errs = append(errs, fmt.Errorf("%s: section '%s' has no adapter", file.origin(key), key))
+		}
+	}
+	return errs
+}
+
+func (section *ConfigSection) validate(schema Schema, alwaysAllowed map[string]bool) []error {
+	errs := make([]error, 0)
+
+	known := make(map[string]bool)
+	for _, key := range schema {
+		known[key.Name] = true
+
+		value := section.tree.GetPath([]string{key.Name})
+		if value == nil {
+			switch {
+			case key.Default != nil:
+				section.tree.SetPath([]string{key.Name}, key.Default)
+			case key.Required:
+				errs = append(errs, fmt.Errorf("%s: section '%s': missing required key '%s'", section.Origin(""), section.name, key.Name))
+			}
+			continue
+		}
+		if err := checkType(key.Type, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: section '%s', key '%s': %v", section.Origin(key.Name), section.name, key.Name, err))
+		}
+	}
+
+	keys := section.tree.Keys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !known[key] && !alwaysAllowed[key] {
+			errs = append(errs, fmt.Errorf("%s: section '%s': unknown key '%s'", section.Origin(key), section.name, key))
+		}
+	}
+	return errs
+}
+
+func checkType(t Type, value any) error {
+	wrongType := fmt.Errorf("should be a %s, not %s", t, describe(value))
+
+	switch t {
+	case TypeString:
+		if _, ok := value.(string); !ok {
+			return wrongType
+		}
+	case TypeInt:
+		if _, ok := value.(int64); !ok {
+			return wrongType
+		}
+	case TypeFloat:
+		_, isFloat := value.(float64)
+		_, isInt := value.(int64)
+		if !isFloat && !isInt {
+			return wrongType
+		}
+	case TypeBool:
+		if _, ok := value.(bool); !ok {
+			return wrongType
+		}
+	case TypeDuration:
+		str, ok := value.(string)
+		if !ok {
+			return wrongType
+		}
+		if _, err := time.ParseDuration(str); err != nil {
+			return fmt.Errorf("'%s' is not a duration like \"90s\" or \"2h\"", str)
+		}
+	case TypeStringSlice:
+		items, ok := value.([]interface{})
+		if !ok {
+			return wrongType
+		}
+		for _, item := range items {
+			if _, ok := item.(string); !ok {
+				return wrongType
+			}
+		}
+	case TypeStringMap:
+		tree, ok := value.(*toml.Tree)
+		if !ok {
+			return wrongType
+		}
+		for _, key := range tree.Keys() {
+			if _, ok := tree.GetPath([]string{key}).(string); !ok {
+				return fmt.Errorf("should be a %s, but %s is %s", t, key, describe(tree.GetPath([]string{key})))
+			}
+		}
+	}
+	return nil
+}
+
+// describe a value loaded by go-toml, for error messages
+func describe(value any) string {
+	switch value.(type) {
+	case string:
+		return "a string"
+	case int64:
+		return "an int"
+	case float64:
+		return "a float"
+	case bool:
+		return "a bool"
+	case []interface{}:
+		return "an array"
+	case *toml.Tree:
+		return "a table"
+	case []*toml.Tree:
+		return "an array of tables"
+	default:
+		return strings.TrimPrefix(fmt.Sprintf("%T", value), "*")
+	}
+}
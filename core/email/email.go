@@ -1,8 +1,10 @@
 package email
 
 import (
+	"context"
 	"fmt"
 	gomail "gopkg.in/mail.v2"
+	"strings"
 
 	conf "github.com/yob/home-data/core/config"
 	"github.com/yob/home-data/core/logging"
@@ -10,64 +12,114 @@ import (
 	"github.com/yob/home-data/pubsub"
 )
 
-func Init(bus *pubsub.Pubsub, logger *logging.Logger, config *conf.ConfigSection) {
-	fromAddress, err := config.GetString("smtp_from")
-	if err != nil {
-		logger.Fatal(fmt.Sprintf("email: smtp_from not set in config - %v", err))
-		return
+// email:send carries a pubsub.Email. Register it here so the journal can decode emails
+// when replaying, even though emails aren't sent during a replay
+func init() {
+	if err := pubsub.RegisterTopic[pubsub.Email]("email:send"); err != nil {
+		panic(err)
 	}
+}
 
-	toAddress, err := config.GetString("smtp_to")
-	if err != nil {
-		logger.Fatal(fmt.Sprintf("email: smtp_to not set in config - %v", err))
-		return
+// The smtp keys are optional, without them emails aren't sent. Setting only some of them
+// is a mistake though, see ValidateConfig
+type configData struct {
+	From     string `config:"smtp_from"`
+	To       string `config:"smtp_to"`
+	Username string `config:"smtp_username"`
+	Password string `config:"smtp_password"`
+	Host     string `config:"smtp_host"`
+	Port     int    `config:"smtp_port"`
+}
+
+// the smtp keys that are set, and the ones that aren't
+func (config configData) keys() (set []string, missing []string) {
+	for _, key := range []struct {
+		name  string
+		unset bool
+	}{
+		{"smtp_from", config.From == ""},
+		{"smtp_to", config.To == ""},
+		{"smtp_username", config.Username == ""},
+		{"smtp_password", config.Password == ""},
+		{"smtp_host", config.Host == ""},
+		{"smtp_port", config.Port == 0},
+	} {
+		if key.unset {
+			missing = append(missing, key.name)
+		} else {
+			set = append(set, key.name)
+		}
 	}
+	return set, missing
+}
 
-	smtpUsername, err := config.GetString("smtp_username")
-	if err != nil {
-		logger.Fatal(fmt.Sprintf("email: smtp_username not set in config - %v", err))
-		return
+// ConfigSchema lists the keys Init reads from the core config section
+var ConfigSchema = conf.SchemaFor(configData{})
+
+// ValidateConfig checks the smtp keys are all set, or none of them are. Half configured
+// email would only fail once something tried to send one, so main refuses to start instead
+func ValidateConfig(configSection *conf.ConfigSection) error {
+	var config configData
+	if err := configSection.Decode(&config); err != nil {
+		// the wrong types are already reported by the schema
+		return nil
+	}
+	set, missing := config.keys()
+	if len(set) == 0 || len(missing) == 0 {
+		return nil
 	}
+	return fmt.Errorf("%s: section '%s': email needs all of the smtp settings or none, missing %s", configSection.Origin(set[0]), configSection.Name(), strings.Join(missing, ", "))
+}
 
-	smtpPassword, err := config.GetString("smtp_password")
-	if err != nil {
-		logger.Fatal(fmt.Sprintf("email: smtp_password not set in config - %v", err))
+func Init(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, configSection *conf.ConfigSection) {
+	var config configData
+	if err := configSection.Decode(&config); err != nil {
+		logger.Fatal(fmt.Sprintf("email: %v", err))
 		return
 	}
-
-	smtpHost, err := config.GetString("smtp_host")
-	if err != nil {
-		logger.Fatal(fmt.Sprintf("email: smtp_host not set in config - %v", err))
+	if config == (configData{}) {
+		logger.Debug("email: no smtp settings in the config, emails won't be sent")
 		return
 	}
-
-	smtpPort, err := config.GetInt("smtp_port")
-	if err != nil {
-		logger.Fatal(fmt.Sprintf("email: smtp_port not set in config - %v", err))
+	// checked by ValidateConfig before anything starts
+	if err := ValidateConfig(configSection); err != nil {
+		logger.Fatal(fmt.Sprintf("email: %v", err))
 		return
 	}
 
-	subEmail, _ := bus.Subscribe("email:send")
+	subEmail, _ := bus.Subscribe(ctx, "email:send")
 	defer subEmail.Close()
 
+	// subscribe to the raw events so emails published with the older NewEmailEvent() are
+	// still sent
 	for event := range subEmail.Ch {
-		if event.Type != "email" {
+		var message pubsub.Email
+		switch event.Type {
+		case "typed":
+			payload, ok := event.Payload.(pubsub.Email)
+			if !ok {
+				continue
+			}
+			message = payload
+		case "email":
+			message = event.Email
+		default:
 			continue
 		}
 
 		m := gomail.NewMessage()
-		m.SetHeader("From", fromAddress)
-		m.SetHeader("To", toAddress)
-		m.SetHeader("Subject", event.Email.Subject)
-		m.SetBody("text/plain", event.Email.Body)
+		m.SetHeader("From", config.From)
+		m.SetHeader("To", config.To)
+		m.SetHeader("Subject", message.Subject)
+		m.SetBody("text/plain", message.Body)
 
-		d := gomail.NewDialer(smtpHost, smtpPort, smtpUsername, smtpPassword)
+		d := gomail.NewDialer(config.Host, config.Port, config.Username, config.Password)
 
 		if err := d.DialAndSend(m); err != nil {
 			logger.Error(fmt.Sprintf("email: failed to send (%v)", err))
 			continue
 		}
 
-		logger.Debug(fmt.Sprintf("email: sent email (%s) to %s", event.Email.Subject, toAddress))
+		logger.Debug(fmt.Sprintf("email: sent email (%s) to %s", message.Subject, config.To))
 	}
 }
@@ -0,0 +1,51 @@
+package email
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	conf "github.com/yob/home-data/core/config"
+)
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		core string
+		want string
+	}{
+		{"no email", ``, ""},
+		{"all set", `
+smtp_from = "home@example.com"
+smtp_to = "me@example.com"
+smtp_username = "home"
+smtp_password = "secret"
+smtp_host = "mail.example.com"
+smtp_port = 587`, ""},
+		{"half set", `
+smtp_host = "mail.example.com"
+smtp_port = 587`, "config.toml: section 'core': email needs all of the smtp settings or none, missing smtp_from, smtp_to, smtp_username, smtp_password"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.toml")
+			if err := os.WriteFile(path, []byte("[core]\n"+test.core+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			configFile, err := conf.NewConfigFromFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			core, _ := configFile.Section("core")
+
+			err = ValidateConfig(core)
+			switch {
+			case test.want == "" && err != nil:
+				t.Errorf("unexpected error %v", err)
+			case test.want != "" && (err == nil || !strings.HasSuffix(err.Error(), test.want)):
+				t.Errorf("expected an error ending %q, got %v", test.want, err)
+			}
+		})
+	}
+}
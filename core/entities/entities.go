@@ -1,126 +1,173 @@
 package entities
 
 import (
-	"fmt"
-	"strconv"
 	"time"
 
+	"github.com/yob/home-data/core/homestate"
 	"github.com/yob/home-data/pubsub"
 )
 
+// Option changes the default behaviour of a sensor
+type Option func(*options)
+
+type options struct {
+	ttl         time.Duration
+	unit        string
+	deviceClass string
+}
+
+// WithTTL removes the sensor value from state if it isn't updated within ttl. Useful for
+// devices that might go offline, so nobody acts on a value that's no longer true
+func WithTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.ttl = ttl
+	}
+}
+
+// WithUnit records the unit of the sensor value in the state metadata, like "celsius"
+func WithUnit(unit string) Option {
+	return func(o *options) {
+		o.unit = unit
+	}
+}
+
+// WithDeviceClass records what the sensor measures in the state metadata, like
+// "temperature"
+func WithDeviceClass(deviceClass string) Option {
+	return func(o *options) {
+		o.deviceClass = deviceClass
+	}
+}
+
+func newOptions(opts []Option) options {
+	var result options
+	for _, opt := range opts {
+		opt(&result)
+	}
+	return result
+}
+
 type SensorBoolean struct {
-	bus   *pubsub.Pubsub
-	topic string
+	bus     *pubsub.Pubsub
+	topic   string
+	options options
 }
 
 type SensorGauge struct {
-	bus   *pubsub.Pubsub
-	topic string
+	bus     *pubsub.Pubsub
+	topic   string
+	options options
 }
 
 type SensorString struct {
-	bus   *pubsub.Pubsub
-	topic string
+	bus     *pubsub.Pubsub
+	topic   string
+	options options
+}
+
+// SensorEnum is for values from a small set of possibilities, like the mode of an AC unit
+type SensorEnum struct {
+	bus     *pubsub.Pubsub
+	topic   string
+	options options
 }
 
 type SensorTime struct {
-	bus   *pubsub.Pubsub
-	topic string
+	bus     *pubsub.Pubsub
+	topic   string
+	options options
 }
 
-func NewSensorBoolean(bus *pubsub.Pubsub, topic string) *SensorBoolean {
+func NewSensorBoolean(bus *pubsub.Pubsub, topic string, opts ...Option) *SensorBoolean {
 	return &SensorBoolean{
-		bus:   bus,
-		topic: topic,
+		bus:     bus,
+		topic:   topic,
+		options: newOptions(opts),
 	}
 }
 
 func (s *SensorBoolean) Update(value bool) {
-	intValue := 0
-	if value {
-		intValue = 1
-	}
-	publish := s.bus.PublishChannel()
-	publish <- pubsub.PubsubEvent{
-		Topic: "state:update",
-		Data:  pubsub.NewKeyValueEvent(s.topic, fmt.Sprintf("%d", intValue)),
-	}
+	publishUpdate(s.bus, s.topic, homestate.BoolValue(value), s.options)
 }
 
 func (s *SensorBoolean) Unset() {
-	publish := s.bus.PublishChannel()
-	publish <- pubsub.PubsubEvent{
-		Topic: "state:delete",
-		Data:  pubsub.NewValueEvent(s.topic),
-	}
+	s.bus.Publish("state:delete", pubsub.NewValueEvent(s.topic))
 }
 
-func NewSensorGauge(bus *pubsub.Pubsub, topic string) *SensorGauge {
+func NewSensorGauge(bus *pubsub.Pubsub, topic string, opts ...Option) *SensorGauge {
 	return &SensorGauge{
-		bus:   bus,
-		topic: topic,
+		bus:     bus,
+		topic:   topic,
+		options: newOptions(opts),
 	}
 }
 
 func (s *SensorGauge) Update(value float64) {
-	strValue := strconv.FormatFloat(value, 'f', 1, 64)
-	publish := s.bus.PublishChannel()
-	publish <- pubsub.PubsubEvent{
-		Topic: "state:update",
-		Data:  pubsub.NewKeyValueEvent(s.topic, strValue),
-	}
+	publishUpdate(s.bus, s.topic, homestate.FloatValue(value), s.options)
 }
 
 func (s *SensorGauge) Unset() {
-	publish := s.bus.PublishChannel()
-	publish <- pubsub.PubsubEvent{
-		Topic: "state:delete",
-		Data:  pubsub.NewValueEvent(s.topic),
-	}
+	s.bus.Publish("state:delete", pubsub.NewValueEvent(s.topic))
 }
 
-func NewSensorString(bus *pubsub.Pubsub, topic string) *SensorString {
+func NewSensorString(bus *pubsub.Pubsub, topic string, opts ...Option) *SensorString {
 	return &SensorString{
-		bus:   bus,
-		topic: topic,
+		bus:     bus,
+		topic:   topic,
+		options: newOptions(opts),
 	}
 }
 
 func (s *SensorString) Update(value string) {
-	publish := s.bus.PublishChannel()
-	publish <- pubsub.PubsubEvent{
-		Topic: "state:update",
-		Data:  pubsub.NewKeyValueEvent(s.topic, value),
-	}
+	publishUpdate(s.bus, s.topic, homestate.StringValue(value), s.options)
 }
 
 func (s *SensorString) Unset() {
-	publish := s.bus.PublishChannel()
-	publish <- pubsub.PubsubEvent{
-		Topic: "state:delete",
-		Data:  pubsub.NewValueEvent(s.topic),
-	}
+	s.bus.Publish("state:delete", pubsub.NewValueEvent(s.topic))
 }
 
-func NewSensorTime(bus *pubsub.Pubsub, topic string) *SensorTime {
+func NewSensorTime(bus *pubsub.Pubsub, topic string, opts ...Option) *SensorTime {
 	return &SensorTime{
-		bus:   bus,
-		topic: topic,
+		bus:     bus,
+		topic:   topic,
+		options: newOptions(opts),
 	}
 }
 
 func (s *SensorTime) Update(value time.Time) {
-	publish := s.bus.PublishChannel()
-	publish <- pubsub.PubsubEvent{
-		Topic: "state:update",
-		Data:  pubsub.NewKeyValueEvent(s.topic, value.Format(time.RFC3339)),
-	}
+	publishUpdate(s.bus, s.topic, homestate.TimeValue(value), s.options)
 }
 
 func (s *SensorTime) Unset() {
-	publish := s.bus.PublishChannel()
-	publish <- pubsub.PubsubEvent{
-		Topic: "state:delete",
-		Data:  pubsub.NewValueEvent(s.topic),
+	s.bus.Publish("state:delete", pubsub.NewValueEvent(s.topic))
+}
+
+func NewSensorEnum(bus *pubsub.Pubsub, topic string, opts ...Option) *SensorEnum {
+	return &SensorEnum{
+		bus:     bus,
+		topic:   topic,
+		options: newOptions(opts),
+	}
+}
+
+func (s *SensorEnum) Update(value string) {
+	publishUpdate(s.bus, s.topic, homestate.EnumValue(value), s.options)
+}
+
+func (s *SensorEnum) Unset() {
+	s.bus.Publish("state:delete", pubsub.NewValueEvent(s.topic))
+}
+
+func publishUpdate(bus *pubsub.Pubsub, key string, value homestate.Value, options options) {
+	update := homestate.Update{
+		Key:         key,
+		Value:       value,
+		TTL:         options.ttl,
+		Unit:        options.unit,
+		DeviceClass: options.deviceClass,
+	}
+	if err := pubsub.Publish(bus, "state:update", update); err != nil {
+		// only possible if someone bound state:update to another type, which is a bug
+		panic(err)
 	}
 }
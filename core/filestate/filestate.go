@@ -0,0 +1,233 @@
+package filestate
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yob/home-data/core/homestate"
+	"github.com/yob/home-data/core/memorystate"
+)
+
+const (
+	// version 1 stored every value as a string, and was never released. Those snapshots
+	// are refused rather than guessing at the types
+	snapshotVersion = 2
+
+	// Writing the whole file for every update would be hard on the SD card in a raspberry
+	// pi. Losing a few seconds of updates in a crash is fine, most values are refreshed
+	// regularly anyway
+	flushInterval = 10 * time.Second
+)
+
+// State keeps everything in memory and regularly writes a snapshot to disk, so values like
+// the last time a rule fired survive a restart. Close must be called before exiting to
+// write the final snapshot.
+type State struct {
+	*memorystate.State
+
+	path    string
+	dirty   atomic.Bool
+	onError func(error)
+
+	// only one snapshot written at a time
+	writeMu sync.Mutex
+
+	stopCh    chan struct{}
+	stoppedCh chan struct{}
+	closeOnce sync.Once
+}
+
+type snapshot struct {
+	Version int
+	SavedAt time.Time
+	Records []memorystate.Record
+}
+
+// New restores the snapshot at path if there is one, and starts writing new snapshots in
+// the background. Errors from the background writes are passed to onError, which can be
+// nil to ignore them. opts are passed to the in memory state, history isn't saved.
+func New(path string, onError func(error), opts ...memorystate.Option) (*State, error) {
+	state := &State{
+		State:     memorystate.New(opts...),
+		path:      path,
+		onError:   onError,
+		stopCh:    make(chan struct{}),
+		stoppedCh: make(chan struct{}),
+	}
+	if err := state.restore(); err != nil {
+		return nil, err
+	}
+
+	go state.flushLoop()
+	return state, nil
+}
+
+func (state *State) Store(key string, value homestate.Value, opts ...homestate.StoreOption) error {
+	defer state.dirty.Store(true)
+	return state.State.Store(key, value, opts...)
+}
+
+func (state *State) StoreMulti(updates map[string]homestate.Value) error {
+	defer state.dirty.Store(true)
+	return state.State.StoreMulti(updates)
+}
+
+func (state *State) CompareAndSwap(key string, old *homestate.Value, new homestate.Value, opts ...homestate.StoreOption) (bool, error) {
+	defer state.dirty.Store(true)
+	return state.State.CompareAndSwap(key, old, new, opts...)
+}
+
+func (state *State) Apply(txn homestate.Txn, opts ...homestate.StoreOption) (bool, error) {
+	defer state.dirty.Store(true)
+	return state.State.Apply(txn, opts...)
+}
+
+func (state *State) Remove(key string) error {
+	defer state.dirty.Store(true)
+	return state.State.Remove(key)
+}
+
+func (state *State) Expire(now time.Time) map[string]homestate.Value {
+	expired := state.State.Expire(now)
+	if len(expired) > 0 {
+		state.dirty.Store(true)
+	}
+	return expired
+}
+
+func (state *State) ReadOnly() homestate.StateReader {
+	return homestate.NewReadOnly(state)
+}
+
+// Flush writes a snapshot now if anything has changed since the last one
+func (state *State) Flush() error {
+	if !state.dirty.Swap(false) {
+		return nil
+	}
+	if err := state.write(); err != nil {
+		// try again next time
+		state.dirty.Store(true)
+		return err
+	}
+	return nil
+}
+
+// Close stops the background writes and writes a final snapshot
+func (state *State) Close() error {
+	state.closeOnce.Do(func() {
+		close(state.stopCh)
+		<-state.stoppedCh
+	})
+	return state.Flush()
+}
+
+func (state *State) flushLoop() {
+	defer close(state.stoppedCh)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := state.Flush(); err != nil && state.onError != nil {
+				state.onError(fmt.Errorf("filestate: error writing %s: %v", state.path, err))
+			}
+		case <-state.stopCh:
+			return
+		}
+	}
+}
+
+func (state *State) restore() error {
+	data, err := os.ReadFile(state.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// check the version before anything else, older records won't decode
+	var version struct{ Version int }
+	if err := json.Unmarshal(data, &version); err != nil {
+		return fmt.Errorf("error reading state snapshot %s: %v", state.path, err)
+	}
+	if version.Version != snapshotVersion {
+		return fmt.Errorf("state snapshot %s has unsupported version %d", state.path, version.Version)
+	}
+	var saved snapshot
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("error reading state snapshot %s: %v", state.path, err)
+	}
+
+	// anything that expired while we were stopped stays gone
+	now := time.Now()
+	records := make([]memorystate.Record, 0, len(saved.Records))
+	for _, record := range saved.Records {
+		if record.ExpiresAt.IsZero() || now.Before(record.ExpiresAt) {
+			records = append(records, record)
+		}
+	}
+	state.State.Restore(records)
+	return nil
+}
+
+// Write the snapshot to a temporary file in the same directory then rename it over the old
+// one. A crash at any point leaves either the old snapshot or the new one, never half of
+// each.
+func (state *State) write() error {
+	state.writeMu.Lock()
+	defer state.writeMu.Unlock()
+
+	records := state.State.Records()
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Key < records[j].Key
+	})
+	data, err := json.MarshalIndent(snapshot{
+		Version: snapshotVersion,
+		SavedAt: time.Now(),
+		Records: records,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(state.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(state.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once the rename has happened
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), state.path); err != nil {
+		return err
+	}
+
+	// make sure the rename itself is on disk
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dirFile.Close()
+	return dirFile.Sync()
+}
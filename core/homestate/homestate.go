@@ -5,17 +5,225 @@ import (
 )
 
 type State interface {
-	Read(string) (string, bool)
-	ReadFloat64(string) (float64, bool)
-	ReadTime(string) (time.Time, bool)
-	Store(string, string) error
-	StoreMulti(map[string]string) error
+	StateReader
+	Store(string, Value, ...StoreOption) error
+	StoreMulti(map[string]Value) error
 	Remove(string) error
+	Expire(time.Time) map[string]Value
 	ReadOnly() StateReader
+
+	// CompareAndSwap stores new only if key currently holds old, or is missing when old is
+	// nil. It returns false if it didn't store anything
+	CompareAndSwap(key string, old *Value, new Value, opts ...StoreOption) (bool, error)
+
+	// Apply makes every write in txn if every condition holds, and nothing otherwise. It
+	// returns false if a condition didn't hold. The options apply to every write
+	Apply(txn Txn, opts ...StoreOption) (bool, error)
 }
 
 type StateReader interface {
+	// Read returns any kind of value as a string, for logging and displaying to humans
 	Read(string) (string, bool)
-	ReadFloat64(string) (float64, bool)
-	ReadTime(string) (time.Time, bool)
+	ReadValue(string) (Value, bool)
+
+	// The typed reads return ErrNotFound if the key isn't in state, and ErrWrongKind if it
+	// was stored as a different kind
+	ReadFloat64(string) (float64, error)
+	ReadInt(string) (int64, error)
+	ReadBool(string) (bool, error)
+	ReadTime(string) (time.Time, error)
+	ReadEnum(string) (string, error)
+
+	Age(string) (time.Duration, bool)
+	ReadMetadata(string) (Metadata, bool)
+
+	// Keys returns the keys that match a pattern, sorted. Patterns use the same rules as
+	// bus topics (see pubsub.MatchTopic), so "ruuvi.#" matches every ruuvi key and
+	// "ruuvi.*.temp_celcius" matches the temperature from every tag
+	Keys(string) ([]string, error)
+
+	// ReadPrefix returns every key that starts with prefix, along with its value
+	ReadPrefix(string) (map[string]Value, error)
+
+	// Snapshot returns every key and value. The values are all read at the same moment, so
+	// they're consistent with each other
+	//
+	// Keys, ReadPrefix and Snapshot only return an error when the state can't be read, so
+	// a broken database isn't mistaken for an empty one
+	Snapshot() (map[string]Value, error)
+
+	HistoryReader
+}
+
+// Metadata describes a stored value
+type Metadata struct {
+	// Unit and DeviceClass are set by the adapter that publishes the value, and kept until
+	// it publishes a different one. Either can be empty
+	Unit        string
+	DeviceClass string
+
+	// the source of the event that last stored the value, usually an adapter
+	Source string
+
+	UpdatedAt   time.Time
+	UpdateCount uint64
+}
+
+// HistoryReader answers questions about recent values of numeric keys. How much history
+// is available depends on how the state was configured, and history is discarded when a
+// key is removed or expires. The window is how far back to look from now.
+type HistoryReader interface {
+	Min(key string, window time.Duration) (float64, bool)
+	Max(key string, window time.Duration) (float64, bool)
+	Mean(key string, window time.Duration) (float64, bool)
+	RateOfChange(key string, window time.Duration) (float64, bool)
+	LastN(key string, n int) []Sample
+}
+
+// Sample is a numeric value of a key at a point in time
+type Sample struct {
+	Value float64
+	At    time.Time
+}
+
+// Update is the payload for state:update events. Older code publishes key-value events
+// instead, and they're still supported, see InferValue
+type Update struct {
+	Key   string
+	Value Value
+
+	// If set, the key is removed if it isn't updated again within TTL. Use it for values
+	// that become misleading when the device that reports them goes offline
+	TTL time.Duration
+
+	// optional, see Metadata
+	Unit        string
+	DeviceClass string
+}
+
+// PayloadKey lets the bus coalesce updates to the same key
+func (u Update) PayloadKey() string {
+	return u.Key
+}
+
+// Change is the payload for state:changed events, published after a key is stored with a
+// different value to the one it had, or removed
+type Change struct {
+	Key string
+	Old Value
+	New Value
+
+	// Added is true if the key had no value before, and Deleted is true if it has no value
+	// now. Old and New are empty strings in those cases
+	Added   bool
+	Deleted bool
+}
+
+// PayloadKey lets the bus coalesce changes to the same key
+func (c Change) PayloadKey() string {
+	return c.Key
+}
+
+// Swap is the payload for state:cas requests, see State.CompareAndSwap
+type Swap struct {
+	Key string
+	Old *Value // nil if the key should be missing
+	New Value
+
+	TTL         time.Duration
+	Unit        string
+	DeviceClass string
+}
+
+// Txn is a group of writes that are made together or not at all. It's the payload for
+// state:txn requests, see State.Apply
+type Txn struct {
+	Conditions []Condition
+	Writes     []Write
+}
+
+// Condition is something that must be true about a key for a Txn to be applied
+type Condition struct {
+	Key   string
+	Value *Value // nil if the key should be missing
+}
+
+// Expect is a condition that key still has the value returned by ReadValue, including
+// still being missing if ok was false
+func Expect(key string, value Value, ok bool) Condition {
+	if !ok {
+		return Condition{Key: key}
+	}
+	return Condition{Key: key, Value: &value}
+}
+
+// Write is a single change in a Txn
+type Write struct {
+	Key   string
+	Value *Value // nil removes the key
+
+	// optional, like the fields in Update
+	TTL         time.Duration
+	Unit        string
+	DeviceClass string
+}
+
+// TxnResult is the reply to state:cas and state:txn requests
+type TxnResult struct {
+	Applied bool
+}
+
+type StoreOptions struct {
+	TTL         time.Duration
+	Unit        string
+	DeviceClass string
+	Source      string
+}
+
+type StoreOption func(*StoreOptions)
+
+// WithTTL expires the stored value after ttl. A zero ttl never expires
+func WithTTL(ttl time.Duration) StoreOption {
+	return func(opts *StoreOptions) {
+		opts.TTL = ttl
+	}
+}
+
+// WithUnit records the unit of the value, like "celsius" or "kWh"
+func WithUnit(unit string) StoreOption {
+	return func(opts *StoreOptions) {
+		opts.Unit = unit
+	}
+}
+
+// WithDeviceClass records what sort of thing the value measures, like "temperature"
+func WithDeviceClass(deviceClass string) StoreOption {
+	return func(opts *StoreOptions) {
+		opts.DeviceClass = deviceClass
+	}
+}
+
+// WithSource records where the value came from
+func WithSource(source string) StoreOption {
+	return func(opts *StoreOptions) {
+		opts.Source = source
+	}
+}
+
+func NewStoreOptions(opts ...StoreOption) StoreOptions {
+	var result StoreOptions
+	for _, opt := range opts {
+		opt(&result)
+	}
+	return result
+}
+
+type readOnly struct {
+	StateReader
+}
+
+// NewReadOnly wraps state so that only the read methods are reachable, even with a type
+// assertion
+func NewReadOnly(state StateReader) StateReader {
+	return readOnly{StateReader: state}
 }
@@ -0,0 +1,255 @@
+package homestate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when reading a key that isn't in state
+	ErrNotFound = errors.New("homestate: key not found")
+
+	// ErrWrongKind is returned when reading a value as a different kind to the one it was
+	// stored as. Values are never converted, reading a bool as a float is a bug
+	ErrWrongKind = errors.New("homestate: value is a different kind")
+)
+
+// Kind is the type of a stored value
+type Kind int
+
+const (
+	KindString Kind = iota
+	KindFloat
+	KindInt
+	KindBool
+	KindTime
+	KindEnum
+)
+
+func (kind Kind) String() string {
+	switch kind {
+	case KindString:
+		return "string"
+	case KindFloat:
+		return "float"
+	case KindInt:
+		return "int"
+	case KindBool:
+		return "bool"
+	case KindTime:
+		return "time"
+	case KindEnum:
+		return "enum"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(kind))
+	}
+}
+
+func ParseKind(name string) (Kind, error) {
+	for kind := KindString; kind <= KindEnum; kind++ {
+		if kind.String() == name {
+			return kind, nil
+		}
+	}
+	return KindString, fmt.Errorf("homestate: unknown kind '%s'", name)
+}
+
+// Value is a typed state value. Create one with the function for its kind, like
+// FloatValue(21.5), and read it back with the matching method.
+type Value struct {
+	kind    Kind
+	str     string // string and enum
+	number  float64
+	integer int64
+	boolean bool
+	time    time.Time
+}
+
+func StringValue(value string) Value {
+	return Value{kind: KindString, str: value}
+}
+
+func FloatValue(value float64) Value {
+	return Value{kind: KindFloat, number: value}
+}
+
+func IntValue(value int64) Value {
+	return Value{kind: KindInt, integer: value}
+}
+
+func BoolValue(value bool) Value {
+	return Value{kind: KindBool, boolean: value}
+}
+
+func TimeValue(value time.Time) Value {
+	return Value{kind: KindTime, time: value}
+}
+
+// EnumValue is a string from a small set of possibilities, like the mode of an AC unit
+func EnumValue(value string) Value {
+	return Value{kind: KindEnum, str: value}
+}
+
+// ParseValue converts the string form of a value, as returned by Value.String, back to a
+// Value of the given kind
+func ParseValue(kind Kind, value string) (Value, error) {
+	switch kind {
+	case KindString:
+		return StringValue(value), nil
+	case KindFloat:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return Value{}, err
+		}
+		return FloatValue(number), nil
+	case KindInt:
+		integer, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return Value{}, err
+		}
+		return IntValue(integer), nil
+	case KindBool:
+		boolean, err := strconv.ParseBool(value)
+		if err != nil {
+			return Value{}, err
+		}
+		return BoolValue(boolean), nil
+	case KindTime:
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return Value{}, err
+		}
+		return TimeValue(t), nil
+	case KindEnum:
+		return EnumValue(value), nil
+	default:
+		return Value{}, fmt.Errorf("homestate: unknown kind %d", int(kind))
+	}
+}
+
+// InferValue guesses the kind of an untyped string. It's only for values that were stored
+// before state was typed, like old key-value events and snapshots. Numbers become floats,
+// RFC3339 times become times and everything else is a string
+func InferValue(value string) Value {
+	if number, err := strconv.ParseFloat(value, 64); err == nil {
+		return FloatValue(number)
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return TimeValue(t)
+	}
+	return StringValue(value)
+}
+
+func (v Value) Kind() Kind {
+	return v.kind
+}
+
+// String formats any kind of value for humans, and for ParseValue
+func (v Value) String() string {
+	switch v.kind {
+	case KindFloat:
+		return strconv.FormatFloat(v.number, 'f', -1, 64)
+	case KindInt:
+		return strconv.FormatInt(v.integer, 10)
+	case KindBool:
+		return strconv.FormatBool(v.boolean)
+	case KindTime:
+		return v.time.Format(time.RFC3339Nano)
+	default:
+		return v.str
+	}
+}
+
+func (v Value) Float64() (float64, error) {
+	if err := v.expect(KindFloat); err != nil {
+		return 0, err
+	}
+	return v.number, nil
+}
+
+func (v Value) Int64() (int64, error) {
+	if err := v.expect(KindInt); err != nil {
+		return 0, err
+	}
+	return v.integer, nil
+}
+
+func (v Value) Bool() (bool, error) {
+	if err := v.expect(KindBool); err != nil {
+		return false, err
+	}
+	return v.boolean, nil
+}
+
+func (v Value) Time() (time.Time, error) {
+	if err := v.expect(KindTime); err != nil {
+		return time.Time{}, err
+	}
+	return v.time, nil
+}
+
+func (v Value) Enum() (string, error) {
+	if err := v.expect(KindEnum); err != nil {
+		return "", err
+	}
+	return v.str, nil
+}
+
+// Numeric returns float and int values as a float64, for code that doesn't care which
+// it has. ok is false for every other kind
+func (v Value) Numeric() (float64, bool) {
+	switch v.kind {
+	case KindFloat:
+		return v.number, true
+	case KindInt:
+		return float64(v.integer), true
+	default:
+		return 0, false
+	}
+}
+
+// Equal is true if both values have the same kind and the same value
+func (v Value) Equal(other Value) bool {
+	if v.kind == KindTime && other.kind == KindTime {
+		return v.time.Equal(other.time)
+	}
+	return v == other
+}
+
+func (v Value) expect(kind Kind) error {
+	if v.kind != kind {
+		return fmt.Errorf("%w: %s is a %s, not a %s", ErrWrongKind, v.String(), v.kind, kind)
+	}
+	return nil
+}
+
+// values are encoded as their kind and string form, which keeps the journal and
+// snapshots easy to read
+type jsonValue struct {
+	Kind  string
+	Value string
+}
+
+func (v Value) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonValue{Kind: v.kind.String(), Value: v.String()})
+}
+
+func (v *Value) UnmarshalJSON(data []byte) error {
+	var encoded jsonValue
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	kind, err := ParseKind(encoded.Kind)
+	if err != nil {
+		return err
+	}
+	parsed, err := ParseValue(kind, encoded.Value)
+	if err != nil {
+		return err
+	}
+	*v = parsed
+	return nil
+}
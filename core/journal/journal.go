@@ -0,0 +1,367 @@
+package journal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	conf "github.com/yob/home-data/core/config"
+	"github.com/yob/home-data/core/logging"
+	"github.com/yob/home-data/pubsub"
+)
+
+const (
+	currentFileName = "journal.jsonl"
+
+	// events waiting to be written. A slow disk loses the oldest ones once this fills up,
+	// rather than holding up the rest of the bus
+	queueSize = 10000
+
+	// how often to log that events are being dropped, or can't be written. Errors are
+	// published on log:new, which the journal writes too, so a failing disk would
+	// otherwise flood the bus with errors about itself
+	reportInterval = time.Minute
+)
+
+type configData struct {
+	Path     string `config:"journal_path"`
+	MaxBytes int64  `config:"journal_max_bytes" default:"10485760"` // 10MB
+	MaxFiles int    `config:"journal_max_files" default:"10"`
+}
+
+// ConfigSchema lists the keys Init reads from the core config section. The journal is
+// only written when journal_path is set
+var ConfigSchema = conf.SchemaFor(configData{})
+
+// Init appends every event on the bus to a journal file in the directory configured
+// with journal_path. When the file grows past journal_max_bytes it's renamed with a
+// timestamp and a new one is started, and only the newest journal_max_files are kept.
+func Init(bus *pubsub.Pubsub, logger *logging.Logger, configSection *conf.ConfigSection) {
+	var config configData
+	if err := configSection.Decode(&config); err != nil {
+		logger.Fatal(fmt.Sprintf("journal: %v", err))
+		return
+	}
+	if config.Path == "" {
+		logger.Fatal("journal: journal_path not set in config")
+		return
+	}
+
+	writer, err := newRotatingWriter(config.Path, config.MaxBytes, config.MaxFiles)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("journal: %v", err))
+		return
+	}
+	defer writer.Close()
+
+	// keep going until the bus is shutdown, the journal should include everything that
+	// happens while the adapters stop
+	subAll, _ := bus.Subscribe(context.Background(), "#", pubsub.WithDropPolicy(pubsub.DropOldest))
+	defer subAll.Close()
+
+	queue := make(chan pubsub.EventData, queueSize)
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		var failed, reportedFailed uint64
+		var reportedAt time.Time
+		for event := range queue {
+			line, err := json.Marshal(newPubsubEvent(event))
+			if err != nil {
+				logger.Error(fmt.Sprintf("journal: failed to encode event %d - %v", event.Seq, err))
+				continue
+			}
+			if err := writer.WriteLine(line); err != nil {
+				failed++
+				if time.Since(reportedAt) > reportInterval {
+					logger.Error(fmt.Sprintf("journal: failed to write %d events (%d in total) - %v", failed-reportedFailed, failed, err))
+					reportedFailed = failed
+					reportedAt = time.Now()
+				}
+			}
+		}
+	}()
+
+	// a gap in the journal makes replays misleading, but a slow SD card shouldn't hold up
+	// every other subscriber. Events wait in the queue, and if that fills up the oldest are
+	// dropped and counted
+	var queueDropped, reportedDropped uint64
+	var reportedAt time.Time
+	for event := range subAll.Ch {
+		select {
+		case queue <- event:
+		default:
+			// we're the only sender, so once an event is taken out there's room
+			select {
+			case <-queue:
+				queueDropped++
+			default:
+			}
+			queue <- event
+		}
+
+		dropped := queueDropped + subAll.Dropped()
+		if dropped > reportedDropped && time.Since(reportedAt) > reportInterval {
+			logger.Error(fmt.Sprintf("journal: %d events dropped because the disk isn't keeping up (%d in total)", dropped-reportedDropped, dropped))
+			reportedDropped = dropped
+			reportedAt = time.Now()
+		}
+	}
+	close(queue)
+	<-written
+}
+
+// Replay reads a journal and publishes the events back onto the bus. path can be a single
+// journal file or a journal directory, in which case every file is replayed from oldest
+// to newest.
+//
+// The gaps between events are preserved, divided by speed. A speed of 2 replays twice as
+// fast as the events were recorded, and a speed of 0 replays as fast as possible.
+//
+// Only the inputs are replayed. Log messages and replies are artifacts of the original
+// run, and events published by anything that's running again during the replay are
+// skipped because it will publish them again itself: the adapters in replayAdapters, and
+// core producers like statebus. Otherwise a replay would double up every decision
+// instead of reproducing it.
+func Replay(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, path string, speed float64, replayAdapters map[string]bool) error {
+	paths, err := journalFiles(path)
+	if err != nil {
+		return err
+	}
+
+	var lastPublishedAt time.Time
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var event pubsub.PubsubEvent
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				logger.Error(fmt.Sprintf("journal: skipping unreadable line in %s - %v", path, err))
+				continue
+			}
+			if skipOnReplay(event, replayAdapters) {
+				continue
+			}
+			if err := decodePayload(&event); err != nil {
+				logger.Error(fmt.Sprintf("journal: skipping event %d in %s - %v", event.Seq, path, err))
+				continue
+			}
+
+			if speed > 0 && !lastPublishedAt.IsZero() && event.PublishedAt.After(lastPublishedAt) {
+				delay := time.Duration(float64(event.PublishedAt.Sub(lastPublishedAt)) / speed)
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					file.Close()
+					return ctx.Err()
+				}
+			}
+			lastPublishedAt = event.PublishedAt
+
+			// the original source is kept so subscribers can still tell where the event came
+			// from, but it's a new event as far as the bus is concerned
+			replayed := pubsub.PubsubEvent{
+				Topic:  event.Topic,
+				Data:   event.Data,
+				Source: event.Source,
+			}
+			select {
+			case bus.PublishChannel() <- replayed:
+			case <-ctx.Done():
+				file.Close()
+				return ctx.Err()
+			}
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("error reading %s: %v", path, err)
+		}
+		logger.Debug(fmt.Sprintf("journal: finished replaying %s", path))
+	}
+	return nil
+}
+
+// AcknowledgeControls replies successfully to every control request on the bus without
+// doing anything. During a replay the device adapters aren't running, and this stops
+// rules waiting for replies that will never arrive
+func AcknowledgeControls(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger) {
+	subAll, _ := bus.Subscribe(ctx, "#")
+	defer subAll.Close()
+
+	for event := range subAll.Ch {
+		if !strings.HasSuffix(event.Topic, ".control") {
+			continue
+		}
+		logger.Debug(fmt.Sprintf("journal: replay would have sent %s to %s", event.Key, event.Topic))
+		bus.Reply(event, pubsub.NewReplyEvent(nil))
+	}
+}
+
+// convert a delivered event back to the envelope it was published in. The envelope
+// fields are only kept once, at the top level
+func newPubsubEvent(event pubsub.EventData) pubsub.PubsubEvent {
+	result := pubsub.PubsubEvent{
+		Topic:       event.Topic,
+		Seq:         event.Seq,
+		PublishedAt: event.PublishedAt,
+		Source:      event.Source,
+	}
+	event.Topic = ""
+	event.Seq = 0
+	event.PublishedAt = time.Time{}
+	event.Source = ""
+	event.ReplyTo = ""
+	result.Data = event
+	return result
+}
+
+// typed payloads come back from JSON as maps. Convert them to the type that subscribers to
+// the topic expect
+func decodePayload(event *pubsub.PubsubEvent) error {
+	if event.Data.Payload == nil {
+		return nil
+	}
+	payloadType, ok := pubsub.PayloadType(event.Topic)
+	if !ok {
+		return fmt.Errorf("no payload type registered for %s", event.Topic)
+	}
+
+	raw, err := json.Marshal(event.Data.Payload)
+	if err != nil {
+		return err
+	}
+	payload := reflect.New(payloadType)
+	if err := json.Unmarshal(raw, payload.Interface()); err != nil {
+		return err
+	}
+	event.Data.Payload = payload.Elem().Interface()
+	return nil
+}
+
+// core goroutines that run during a replay as well, publishing the same events they did
+// the first time. statebus turns the replayed state:update events back into state:changed
+var liveDuringReplay = map[string]bool{
+	"statebus":   true,
+	"busmetrics": true,
+}
+
+func skipOnReplay(event pubsub.PubsubEvent, replayAdapters map[string]bool) bool {
+	topic := event.Topic
+	if pubsub.MatchTopic("log:new", topic) || pubsub.MatchTopic("reply:*", topic) ||
+		topic == "state:cas" || topic == "state:txn" {
+		return true
+	}
+	// adapters that can be configured more than once have a source like "daikin.study"
+	adapterName, _, _ := strings.Cut(event.Source, ".")
+	return liveDuringReplay[adapterName] || replayAdapters[adapterName]
+}
+
+// the journal files at path in the order they were written. Rotated files are named with
+// a timestamp, and "journal-<timestamp>" sorts before "journal.jsonl"
+func journalFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(path, "journal*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+type rotatingWriter struct {
+	dir      string
+	maxBytes int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func newRotatingWriter(dir string, maxBytes int64, maxFiles int) (*rotatingWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	writer := &rotatingWriter{
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxFiles: maxFiles,
+	}
+	if err := writer.open(); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+func (w *rotatingWriter) WriteLine(line []byte) error {
+	if w.size > 0 && w.size+int64(len(line))+1 > w.maxBytes {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.file.Write(append(line, '\n'))
+	w.size += int64(n)
+	return err
+}
+
+func (w *rotatingWriter) Close() error {
+	return w.file.Close()
+}
+
+func (w *rotatingWriter) open() error {
+	file, err := os.OpenFile(filepath.Join(w.dir, currentFileName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = info.Size()
+	return nil
+}
+
+func (w *rotatingWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	rotatedName := fmt.Sprintf("journal-%s.jsonl", time.Now().UTC().Format("20060102T150405.000000000Z"))
+	if err := os.Rename(filepath.Join(w.dir, currentFileName), filepath.Join(w.dir, rotatedName)); err != nil {
+		return err
+	}
+
+	// the current file is included in the limit
+	rotated, err := filepath.Glob(filepath.Join(w.dir, "journal-*.jsonl"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(rotated)
+	for len(rotated) > 0 && len(rotated) > w.maxFiles-1 {
+		if err := os.Remove(rotated[0]); err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+
+	return w.open()
+}
@@ -0,0 +1,138 @@
+package journal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	conf "github.com/yob/home-data/core/config"
+	"github.com/yob/home-data/core/logging"
+	"github.com/yob/home-data/pubsub"
+)
+
+func TestReplaySkipsEventsThatAreProducedAgain(t *testing.T) {
+	recorded := []pubsub.PubsubEvent{
+		{Topic: "state:update", Source: "ruuvigateway", Data: pubsub.NewKeyValueEvent("ruuvi.kitchen.temp_celcius", "21")},
+		{Topic: "state:changed", Source: "statebus", Data: pubsub.NewKeyValueEvent("ruuvi.kitchen.temp_celcius", "21")},
+		{Topic: "state:update", Source: "rules", Data: pubsub.NewKeyValueEvent("kasa.heater.on_last_at", "x")},
+		{Topic: "email:send", Source: "rules", Data: pubsub.NewEmailEvent("subject", "body")},
+		{Topic: "kasa.heater.control", Source: "rules", Data: pubsub.NewKeyValueEvent("power", "on")},
+		{Topic: "log:new", Source: "daikin.study", Data: pubsub.NewKeyValueEvent("DEBUG", "hello")},
+		{Topic: "every:minute", Source: "timers", Data: pubsub.NewValueEvent("")},
+		{Topic: "state:update", Source: "daikin.study", Data: pubsub.NewKeyValueEvent("daikin.study.power", "true")},
+	}
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range recorded {
+		line, _ := json.Marshal(event)
+		file.Write(append(line, '\n'))
+	}
+	file.Close()
+
+	ps := pubsub.NewPubsub(pubsub.WithDefaultDropPolicy(pubsub.Block))
+	go ps.Run()
+	sub, _ := ps.Subscribe(context.Background(), "#")
+	defer sub.Close()
+
+	err = Replay(context.Background(), ps, logging.NewLogger(ps), path, 0, map[string]bool{"rules": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"ruuvigateway state:update", "timers every:minute", "daikin.study state:update"}
+	for _, expected := range want {
+		select {
+		case event := <-sub.Ch:
+			if event.Topic == "log:new" {
+				// the replay logs when it finishes a file
+				event = <-sub.Ch
+			}
+			if got := event.Source + " " + event.Topic; got != expected {
+				t.Errorf("replayed %s, expected %s", got, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s wasn't replayed", expected)
+		}
+	}
+}
+
+func TestReplayStopsWhenCancelled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	line, _ := json.Marshal(pubsub.PubsubEvent{Topic: "every:minute", Source: "timers"})
+	os.WriteFile(path, append(line, '\n'), 0644)
+
+	// nothing is running the bus, so publishing can't complete once the channel is full
+	ps := pubsub.NewPubsub()
+	for len(ps.PublishChannel()) < cap(ps.PublishChannel()) {
+		ps.PublishChannel() <- pubsub.PubsubEvent{Topic: "filler"}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := Replay(ctx, ps, logging.NewLogger(ps), path, 0, nil); err != context.DeadlineExceeded {
+		t.Errorf("expected the deadline to stop the replay, got %v", err)
+	}
+}
+
+func TestInitReportsWriteErrorsWithoutLooping(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("needs /dev/full to fail writes")
+	}
+	dir := t.TempDir()
+	if err := os.Symlink("/dev/full", filepath.Join(dir, currentFileName)); err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(t.TempDir(), "config.toml")
+	os.WriteFile(configPath, []byte(fmt.Sprintf("[core]\njournal_path = %q\n", dir)), 0644)
+	configFile, err := conf.NewConfigFromFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coreConfig, _ := configFile.Section("core")
+
+	ps := pubsub.NewPubsub()
+	go ps.Run()
+	logs, _ := ps.Subscribe(context.Background(), "log:new")
+	defer logs.Close()
+
+	stopped := make(chan struct{})
+	go func() {
+		bus := ps.WithSource("journal")
+		Init(bus, logging.NewLogger(bus), coreConfig)
+		close(stopped)
+	}()
+	if err := ps.WaitUntilSubscriber("every:minute", 1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		ps.Publish("every:minute", pubsub.NewValueEvent(""))
+	}
+
+	// the error about the first failure can't be written either, but it shouldn't cause
+	// another one to be logged
+	errors := 0
+	timeout := time.After(200 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case event := <-logs.Ch:
+			if event.Key == "ERROR" {
+				errors++
+			}
+		case <-timeout:
+			done = true
+		}
+	}
+	if errors != 1 {
+		t.Errorf("expected one error about the failed writes, got %d", errors)
+	}
+
+	ps.Shutdown(context.Background())
+	<-stopped
+}
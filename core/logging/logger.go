@@ -15,22 +15,13 @@ func NewLogger(bus *pubsub.Pubsub) *Logger {
 }
 
 func (logger *Logger) Debug(message string) {
-	logger.bus.PublishChannel() <- pubsub.PubsubEvent{
-		Topic: "log:new",
-		Data:  pubsub.NewKeyValueEvent("DEBUG", message),
-	}
+	logger.bus.Publish("log:new", pubsub.NewKeyValueEvent("DEBUG", message))
 }
 
 func (logger *Logger) Error(message string) {
-	logger.bus.PublishChannel() <- pubsub.PubsubEvent{
-		Topic: "log:new",
-		Data:  pubsub.NewKeyValueEvent("ERROR", message),
-	}
+	logger.bus.Publish("log:new", pubsub.NewKeyValueEvent("ERROR", message))
 }
 
 func (logger *Logger) Fatal(message string) {
-	logger.bus.PublishChannel() <- pubsub.PubsubEvent{
-		Topic: "log:new",
-		Data:  pubsub.NewKeyValueEvent("FATAL", message),
-	}
+	logger.bus.Publish("log:new", pubsub.NewKeyValueEvent("FATAL", message))
 }
@@ -1,16 +1,30 @@
 package logging
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/yob/home-data/pubsub"
 )
 
 func Init(bus *pubsub.Pubsub) {
-	subLog, _ := bus.Subscribe("log:new")
+	// keep printing until the bus is shutdown, so messages logged while everything else
+	// is stopping aren't lost
+	subLog, _ := bus.Subscribe(context.Background(), "log:new")
 	defer subLog.Close()
 
 	for event := range subLog.Ch {
-		fmt.Printf("%s: %s\n", event.Key, event.Value)
+		// include the envelope so it's possible to debug ordering and lag between the
+		// event being published and printed
+		lag := time.Since(event.PublishedAt).Round(time.Millisecond)
+		fmt.Printf("%s: %s (source: %s seq: %d lag: %s)\n", event.Key, event.Value, sourceName(event.Source), event.Seq, lag)
 	}
 }
+
+func sourceName(source string) string {
+	if source == "" {
+		return "unknown"
+	}
+	return source
+}
@@ -0,0 +1,169 @@
+package memorystate
+
+import (
+	"time"
+
+	"github.com/yob/home-data/core/homestate"
+)
+
+// the history kept for each key when New isn't given WithHistory
+const (
+	DefaultHistoryRetention  = 1 * time.Hour
+	DefaultHistoryMaxSamples = 1000
+)
+
+// Option changes the defaults for a new State
+type Option func(*State)
+
+// WithHistory sets how much history is kept for each numeric key. Samples older than
+// retention are discarded, and so are the oldest samples once there's maxSamples of them.
+// A retention of zero disables history.
+func WithHistory(retention time.Duration, maxSamples int) Option {
+	return func(state *State) {
+		state.historyRetention = retention
+		state.historyMaxSamples = maxSamples
+	}
+}
+
+// a fixed size ring buffer of samples for a single key, oldest first
+type history struct {
+	samples []homestate.Sample
+	start   int
+	count   int
+}
+
+func newHistory(maxSamples int) *history {
+	return &history{samples: make([]homestate.Sample, maxSamples)}
+}
+
+func (h *history) add(sample homestate.Sample, retention time.Duration) {
+	if h.count == len(h.samples) {
+		h.start = (h.start + 1) % len(h.samples)
+		h.count--
+	}
+	h.samples[(h.start+h.count)%len(h.samples)] = sample
+	h.count++
+
+	cutoff := sample.At.Add(-retention)
+	for h.count > 0 && h.at(0).At.Before(cutoff) {
+		h.start = (h.start + 1) % len(h.samples)
+		h.count--
+	}
+}
+
+func (h *history) at(idx int) homestate.Sample {
+	return h.samples[(h.start+idx)%len(h.samples)]
+}
+
+// samples no older than since, oldest first
+func (h *history) since(since time.Time) []homestate.Sample {
+	result := make([]homestate.Sample, 0, h.count)
+	for idx := 0; idx < h.count; idx++ {
+		if sample := h.at(idx); !sample.At.Before(since) {
+			result = append(result, sample)
+		}
+	}
+	return result
+}
+
+func (h *history) last(n int) []homestate.Sample {
+	if n > h.count {
+		n = h.count
+	}
+	result := make([]homestate.Sample, 0, n)
+	for idx := h.count - n; idx < h.count; idx++ {
+		result = append(result, h.at(idx))
+	}
+	return result
+}
+
+// only called with the write lock held
+func (state *State) recordSample(key string, value float64, at time.Time) {
+	if state.historyRetention <= 0 || state.historyMaxSamples <= 0 {
+		return
+	}
+	keyHistory, ok := state.history[key]
+	if !ok {
+		keyHistory = newHistory(state.historyMaxSamples)
+		state.history[key] = keyHistory
+	}
+	keyHistory.add(homestate.Sample{Value: value, At: at}, state.historyRetention)
+}
+
+func (state *State) samplesSince(key string, window time.Duration) []homestate.Sample {
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+
+	keyHistory, ok := state.history[key]
+	if !ok {
+		return nil
+	}
+	return keyHistory.since(time.Now().Add(-window))
+}
+
+// Min returns the lowest value stored for key within window
+func (state *State) Min(key string, window time.Duration) (float64, bool) {
+	samples := state.samplesSince(key, window)
+	if len(samples) == 0 {
+		return 0, false
+	}
+	result := samples[0].Value
+	for _, sample := range samples[1:] {
+		result = min(result, sample.Value)
+	}
+	return result, true
+}
+
+// Max returns the highest value stored for key within window
+func (state *State) Max(key string, window time.Duration) (float64, bool) {
+	samples := state.samplesSince(key, window)
+	if len(samples) == 0 {
+		return 0, false
+	}
+	result := samples[0].Value
+	for _, sample := range samples[1:] {
+		result = max(result, sample.Value)
+	}
+	return result, true
+}
+
+// Mean returns the average of the values stored for key within window. Each sample counts
+// the same, regardless of how long the value was current for
+func (state *State) Mean(key string, window time.Duration) (float64, bool) {
+	samples := state.samplesSince(key, window)
+	if len(samples) == 0 {
+		return 0, false
+	}
+	total := 0.0
+	for _, sample := range samples {
+		total += sample.Value
+	}
+	return total / float64(len(samples)), true
+}
+
+// RateOfChange returns how much the value of key changed per second, between the oldest
+// and newest samples within window. It needs at least two samples at different times
+func (state *State) RateOfChange(key string, window time.Duration) (float64, bool) {
+	samples := state.samplesSince(key, window)
+	if len(samples) < 2 {
+		return 0, false
+	}
+	first, last := samples[0], samples[len(samples)-1]
+	elapsed := last.At.Sub(first.At).Seconds()
+	if elapsed <= 0 {
+		return 0, false
+	}
+	return (last.Value - first.Value) / elapsed, true
+}
+
+// LastN returns up to n of the most recent values stored for key, oldest first
+func (state *State) LastN(key string, n int) []homestate.Sample {
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+
+	keyHistory, ok := state.history[key]
+	if !ok || n <= 0 {
+		return nil
+	}
+	return keyHistory.last(n)
+}
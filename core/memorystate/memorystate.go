@@ -1,87 +1,372 @@
 package memorystate
 
 import (
-	"strconv"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/yob/home-data/core/homestate"
+	"github.com/yob/home-data/pubsub"
 )
 
 type State struct {
-	data *sync.Map
+	mu      sync.RWMutex
+	data    map[string]entry
+	history map[string]*history
+
+	historyRetention  time.Duration
+	historyMaxSamples int
+}
+
+type entry struct {
+	value     homestate.Value
+	expiresAt time.Time // zero if the value never expires
+	metadata  homestate.Metadata
 }
 
-type readOnlyState struct {
-	writeableState *State
+func (e entry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
 }
 
-func New() *State {
-	return &State{
-		data: &sync.Map{},
+func New(opts ...Option) *State {
+	state := &State{
+		data:              make(map[string]entry),
+		history:           make(map[string]*history),
+		historyRetention:  DefaultHistoryRetention,
+		historyMaxSamples: DefaultHistoryMaxSamples,
 	}
+	for _, opt := range opts {
+		opt(state)
+	}
+	return state
 }
 
 func (state *State) Read(key string) (string, bool) {
-	if value, ok := state.data.Load(key); ok {
-		return value.(string), true
+	if entry, ok := state.load(key); ok {
+		return entry.value.String(), true
 	}
 	return "", false
 }
 
-func (state *State) ReadFloat64(key string) (float64, bool) {
-	if value, ok := state.data.Load(key); ok {
-		value64, err := strconv.ParseFloat(value.(string), 8)
-		if err != nil {
-			return 0, false
-		}
-		return value64, true
+func (state *State) ReadValue(key string) (homestate.Value, bool) {
+	if entry, ok := state.load(key); ok {
+		return entry.value, true
+	}
+	return homestate.Value{}, false
+}
+
+func (state *State) ReadFloat64(key string) (float64, error) {
+	value, err := state.readValue(key)
+	if err != nil {
+		return 0, err
+	}
+	return value.Float64()
+}
+
+func (state *State) ReadInt(key string) (int64, error) {
+	value, err := state.readValue(key)
+	if err != nil {
+		return 0, err
+	}
+	return value.Int64()
+}
+
+func (state *State) ReadBool(key string) (bool, error) {
+	value, err := state.readValue(key)
+	if err != nil {
+		return false, err
+	}
+	return value.Bool()
+}
+
+func (state *State) ReadTime(key string) (time.Time, error) {
+	value, err := state.readValue(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return value.Time()
+}
+
+func (state *State) ReadEnum(key string) (string, error) {
+	value, err := state.readValue(key)
+	if err != nil {
+		return "", err
+	}
+	return value.Enum()
+}
+
+// Age returns how long ago key was last stored
+func (state *State) Age(key string) (time.Duration, bool) {
+	if entry, ok := state.load(key); ok {
+		return time.Since(entry.metadata.UpdatedAt), true
 	}
 	return 0, false
 }
 
-func (state *State) ReadTime(key string) (time.Time, bool) {
-	if strTime, ok := state.data.Load(key); ok {
-		t, err := time.Parse(time.RFC3339, strTime.(string))
-		if err != nil {
-			return time.Now(), false
-		}
-		return t, true
+func (state *State) ReadMetadata(key string) (homestate.Metadata, bool) {
+	if entry, ok := state.load(key); ok {
+		return entry.metadata, true
 	}
-	return time.Now(), false
+	return homestate.Metadata{}, false
 }
 
 func (state *State) ReadOnly() homestate.StateReader {
-	return &readOnlyState{
-		writeableState: state,
-	}
+	return homestate.NewReadOnly(state)
 }
 
-func (state *State) Store(key string, value string) error {
-	state.data.Store(key, value)
+func (state *State) Store(key string, value homestate.Value, opts ...homestate.StoreOption) error {
+	options := homestate.NewStoreOptions(opts...)
+	now := time.Now()
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.store(key, value, options, now)
 	return nil
 }
 
-func (state *State) StoreMulti(updates map[string]string) error {
+func (state *State) StoreMulti(updates map[string]homestate.Value) error {
+	now := time.Now()
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
 	for key, value := range updates {
-		state.data.Store(key, value)
+		state.store(key, value, homestate.StoreOptions{}, now)
 	}
 	return nil
 }
 
+// Only called with the write lock held. The unit and device class are kept from the
+// previous value unless new ones are provided, plenty of updates don't include them
+func (state *State) store(key string, value homestate.Value, options homestate.StoreOptions, now time.Time) {
+	newEntry := entry{
+		value: value,
+	}
+	if options.TTL > 0 {
+		newEntry.expiresAt = now.Add(options.TTL)
+	}
+
+	metadata := state.data[key].metadata
+	if options.Unit != "" {
+		metadata.Unit = options.Unit
+	}
+	if options.DeviceClass != "" {
+		metadata.DeviceClass = options.DeviceClass
+	}
+	metadata.Source = options.Source
+	metadata.UpdatedAt = now
+	metadata.UpdateCount++
+	newEntry.metadata = metadata
+
+	state.data[key] = newEntry
+	state.recordValue(key, value, now)
+}
+
+func (state *State) CompareAndSwap(key string, old *homestate.Value, new homestate.Value, opts ...homestate.StoreOption) (bool, error) {
+	return state.Apply(homestate.Txn{
+		Conditions: []homestate.Condition{{Key: key, Value: old}},
+		Writes:     []homestate.Write{{Key: key, Value: &new}},
+	}, opts...)
+}
+
+func (state *State) Apply(txn homestate.Txn, opts ...homestate.StoreOption) (bool, error) {
+	for _, write := range txn.Writes {
+		if write.Key == "" {
+			return false, fmt.Errorf("memorystate: transaction has a write with no key")
+		}
+	}
+	options := homestate.NewStoreOptions(opts...)
+	now := time.Now()
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	for _, condition := range txn.Conditions {
+		if !state.holds(condition, now) {
+			return false, nil
+		}
+	}
+	for _, write := range txn.Writes {
+		if write.Value == nil {
+			delete(state.data, write.Key)
+			delete(state.history, write.Key)
+			continue
+		}
+		writeOptions := options
+		writeOptions.TTL = write.TTL
+		writeOptions.Unit = write.Unit
+		writeOptions.DeviceClass = write.DeviceClass
+		state.store(write.Key, *write.Value, writeOptions, now)
+	}
+	return true, nil
+}
+
+// Only called with a lock held. Expired keys count as missing, like they do for readers
+func (state *State) holds(condition homestate.Condition, now time.Time) bool {
+	entry, ok := state.data[condition.Key]
+	if ok && entry.expired(now) {
+		ok = false
+	}
+	if condition.Value == nil {
+		return !ok
+	}
+	return ok && entry.value.Equal(*condition.Value)
+}
+
 func (state *State) Remove(key string) error {
-	state.data.Delete(key)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	delete(state.data, key)
+	delete(state.history, key)
 	return nil
 }
 
-func (state *readOnlyState) Read(key string) (string, bool) {
-	return state.writeableState.Read(key)
+// Expire removes every key with a TTL that has lapsed by now, and returns the removed keys
+// along with the values they had
+func (state *State) Expire(now time.Time) map[string]homestate.Value {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	expired := make(map[string]homestate.Value)
+	for key, entry := range state.data {
+		if entry.expired(now) {
+			delete(state.data, key)
+			delete(state.history, key)
+			expired[key] = entry.value
+		}
+	}
+	return expired
+}
+
+func (state *State) Keys(pattern string) ([]string, error) {
+	now := time.Now()
+
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+
+	keys := make([]string, 0)
+	for key, entry := range state.data {
+		if pubsub.MatchTopic(pattern, key) && !entry.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// memory can't fail to be read, the errors are only there for other backends
+func (state *State) ReadPrefix(prefix string) (map[string]homestate.Value, error) {
+	return state.filter(func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	}), nil
+}
+
+func (state *State) Snapshot() (map[string]homestate.Value, error) {
+	return state.filter(func(string) bool {
+		return true
+	}), nil
+}
+
+// every unexpired key and value where keep(key) is true, read under a single lock
+func (state *State) filter(keep func(string) bool) map[string]homestate.Value {
+	now := time.Now()
+
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+
+	result := make(map[string]homestate.Value)
+	for key, entry := range state.data {
+		if keep(key) && !entry.expired(now) {
+			result[key] = entry.value
+		}
+	}
+	return result
+}
+
+// Record is a stored key with everything needed to restore it later
+type Record struct {
+	Key         string
+	Value       homestate.Value
+	UpdatedAt   time.Time
+	ExpiresAt   time.Time
+	Unit        string
+	DeviceClass string
+	Source      string
+	UpdateCount uint64
+}
+
+// Records returns every key that hasn't expired, so it can be saved somewhere
+func (state *State) Records() []Record {
+	now := time.Now()
+
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+
+	records := make([]Record, 0, len(state.data))
+	for key, entry := range state.data {
+		if entry.expired(now) {
+			continue
+		}
+		records = append(records, Record{
+			Key:         key,
+			Value:       entry.value,
+			UpdatedAt:   entry.metadata.UpdatedAt,
+			ExpiresAt:   entry.expiresAt,
+			Unit:        entry.metadata.Unit,
+			DeviceClass: entry.metadata.DeviceClass,
+			Source:      entry.metadata.Source,
+			UpdateCount: entry.metadata.UpdateCount,
+		})
+	}
+	return records
+}
+
+// Restore stores records that were previously returned by Records, keeping their original
+// update and expiry times
+func (state *State) Restore(records []Record) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	for _, record := range records {
+		state.data[record.Key] = entry{
+			value:     record.Value,
+			expiresAt: record.ExpiresAt,
+			metadata: homestate.Metadata{
+				Unit:        record.Unit,
+				DeviceClass: record.DeviceClass,
+				Source:      record.Source,
+				UpdatedAt:   record.UpdatedAt,
+				UpdateCount: record.UpdateCount,
+			},
+		}
+	}
 }
 
-func (state *readOnlyState) ReadFloat64(key string) (float64, bool) {
-	return state.writeableState.ReadFloat64(key)
+// numeric values are added to the history for key, anything else is ignored. Only called
+// with the write lock held
+func (state *State) recordValue(key string, value homestate.Value, at time.Time) {
+	if number, ok := value.Numeric(); ok {
+		state.recordSample(key, number, at)
+	}
 }
 
-func (state *readOnlyState) ReadTime(key string) (time.Time, bool) {
-	return state.writeableState.ReadTime(key)
+func (state *State) readValue(key string) (homestate.Value, error) {
+	entry, ok := state.load(key)
+	if !ok {
+		return homestate.Value{}, fmt.Errorf("%w: %s", homestate.ErrNotFound, key)
+	}
+	return entry.value, nil
+}
+
+// expired keys are hidden from readers even before Expire removes them
+func (state *State) load(key string) (entry, bool) {
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+
+	entry, ok := state.data[key]
+	if !ok || entry.expired(time.Now()) {
+		return entry, false
+	}
+	return entry, true
 }
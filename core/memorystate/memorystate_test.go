@@ -0,0 +1,31 @@
+package memorystate
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/yob/home-data/core/homestate"
+)
+
+func TestKeysMatchesLikeBusTopics(t *testing.T) {
+	state := New()
+	for _, key := range []string{"ruuvi.kitchen.temp_celcius", "ruuvi.kitchen.humidity", "ruuvi.outside.temp_celcius", "ruuvi.count", "daikin.study.power"} {
+		state.Store(key, homestate.FloatValue(1))
+	}
+
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"ruuvi.#", []string{"ruuvi.count", "ruuvi.kitchen.humidity", "ruuvi.kitchen.temp_celcius", "ruuvi.outside.temp_celcius"}},
+		{"ruuvi.*", []string{"ruuvi.count"}},
+		{"ruuvi.*.temp_celcius", []string{"ruuvi.kitchen.temp_celcius", "ruuvi.outside.temp_celcius"}},
+		{"daikin.study.power", []string{"daikin.study.power"}},
+		{"kasa.#", []string{}},
+	}
+	for _, test := range tests {
+		if got, _ := state.Keys(test.pattern); !slices.Equal(got, test.want) {
+			t.Errorf("Keys(%s) = %v, want %v", test.pattern, got, test.want)
+		}
+	}
+}
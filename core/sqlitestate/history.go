@@ -0,0 +1,159 @@
+package sqlitestate
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/yob/home-data/core/homestate"
+)
+
+// the history kept for each key when New isn't given WithHistory. It's on disk, so there's
+// room for a lot more than memorystate keeps
+const (
+	DefaultHistoryRetention  = 7 * 24 * time.Hour
+	DefaultHistoryMaxSamples = 100000
+)
+
+// Option changes the defaults for a new State
+type Option func(*State)
+
+// WithHistory sets how much history is kept for each numeric key. Samples older than
+// retention are discarded, and so are the oldest samples once there's maxSamples of them.
+// A retention of zero disables history.
+func WithHistory(retention time.Duration, maxSamples int) Option {
+	return func(state *State) {
+		state.historyRetention = retention
+		state.historyMaxSamples = maxSamples
+	}
+}
+
+// WithErrorHandler passes errors from the background work, like pruning history, to
+// onError. They're ignored without it
+func WithErrorHandler(onError func(error)) Option {
+	return func(state *State) {
+		state.onError = onError
+	}
+}
+
+// only called inside a transaction
+func (state *State) recordSample(tx *sql.Tx, key string, value float64, at time.Time) error {
+	if state.historyRetention <= 0 || state.historyMaxSamples <= 0 {
+		return nil
+	}
+	if _, err := tx.Exec(`INSERT INTO history (key, value, at) VALUES (?, ?, ?)`, key, value, formatTime(at)); err != nil {
+		return err
+	}
+	// ids only increase, so everything older than the newest maxSamples has a lower id
+	_, err := tx.Exec(`DELETE FROM history WHERE key = ? AND id <= (
+		SELECT id FROM history WHERE key = ? ORDER BY id DESC LIMIT 1 OFFSET ?
+	)`, key, key, state.historyMaxSamples)
+	return err
+}
+
+// samples older than the retention are deleted every so often, rather than on every write
+func (state *State) pruneLoop() {
+	defer close(state.stopped)
+
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-state.stop:
+			return
+		case now := <-ticker.C:
+			_, err := state.db.Exec(`DELETE FROM history WHERE at < ?`, formatTime(now.Add(-state.historyRetention)))
+			if err != nil && state.onError != nil {
+				state.onError(fmt.Errorf("sqlitestate: error pruning history: %v", err))
+			}
+		}
+	}
+}
+
+// the retention is applied here as well, pruning might not have caught up
+func (state *State) windowStart(window time.Duration) string {
+	return formatTime(time.Now().Add(-min(window, state.historyRetention)))
+}
+
+// Min returns the lowest value stored for key within window
+func (state *State) Min(key string, window time.Duration) (float64, bool) {
+	return state.aggregate(`SELECT MIN(value) FROM history WHERE key = ? AND at >= ?`, key, window)
+}
+
+// Max returns the highest value stored for key within window
+func (state *State) Max(key string, window time.Duration) (float64, bool) {
+	return state.aggregate(`SELECT MAX(value) FROM history WHERE key = ? AND at >= ?`, key, window)
+}
+
+// Mean returns the average of the values stored for key within window. Each sample counts
+// the same, regardless of how long the value was current for
+func (state *State) Mean(key string, window time.Duration) (float64, bool) {
+	return state.aggregate(`SELECT AVG(value) FROM history WHERE key = ? AND at >= ?`, key, window)
+}
+
+// the aggregates are NULL when there are no samples
+func (state *State) aggregate(query string, key string, window time.Duration) (float64, bool) {
+	var result sql.NullFloat64
+	if err := state.db.QueryRow(query, key, state.windowStart(window)).Scan(&result); err != nil {
+		return 0, false
+	}
+	return result.Float64, result.Valid
+}
+
+// RateOfChange returns how much the value of key changed per second, between the oldest
+// and newest samples within window. It needs at least two samples at different times
+func (state *State) RateOfChange(key string, window time.Duration) (float64, bool) {
+	samples, err := state.samples(`SELECT value, at FROM (
+			SELECT value, at, id FROM history WHERE key = ? AND at >= ? ORDER BY at, id LIMIT 1
+		) UNION ALL SELECT value, at FROM (
+			SELECT value, at, id FROM history WHERE key = ? AND at >= ? ORDER BY at DESC, id DESC LIMIT 1
+		)`, key, state.windowStart(window), key, state.windowStart(window))
+	if err != nil || len(samples) < 2 {
+		return 0, false
+	}
+	first, last := samples[0], samples[1]
+	elapsed := last.At.Sub(first.At).Seconds()
+	if elapsed <= 0 {
+		return 0, false
+	}
+	return (last.Value - first.Value) / elapsed, true
+}
+
+// LastN returns up to n of the most recent values stored for key, oldest first
+func (state *State) LastN(key string, n int) []homestate.Sample {
+	if n <= 0 {
+		return nil
+	}
+	samples, err := state.samples(`SELECT value, at FROM history WHERE key = ? AND at >= ? ORDER BY at DESC, id DESC LIMIT ?`, key, state.windowStart(state.historyRetention), n)
+	if err != nil || len(samples) == 0 {
+		return nil
+	}
+	for i, j := 0, len(samples)-1; i < j; i, j = i+1, j-1 {
+		samples[i], samples[j] = samples[j], samples[i]
+	}
+	return samples
+}
+
+func (state *State) samples(query string, args ...any) ([]homestate.Sample, error) {
+	rows, err := state.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]homestate.Sample, 0)
+	for rows.Next() {
+		var sample homestate.Sample
+		var at string
+		if err := rows.Scan(&sample.Value, &at); err != nil {
+			return nil, err
+		}
+		sample.At, err = time.Parse(timeFormat, at)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, sample)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,80 @@
+package sqlitestate
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Each migration is applied once, in order, and recorded in schema_migrations. Never edit
+// a migration that has been released, add a new one instead.
+//
+// Times are stored as fixed width UTC text (see timeFormat) so they're readable in the
+// sqlite3 shell and sort correctly as strings.
+var migrations = []string{
+	// 1: current values and numeric history
+	`CREATE TABLE state (
+		key TEXT PRIMARY KEY,
+		kind TEXT NOT NULL,
+		value TEXT NOT NULL,
+		number REAL, -- a copy of float and int values, so they're easy to query
+		unit TEXT NOT NULL DEFAULT '',
+		device_class TEXT NOT NULL DEFAULT '',
+		source TEXT NOT NULL DEFAULT '',
+		updated_at TEXT NOT NULL,
+		update_count INTEGER NOT NULL DEFAULT 0,
+		expires_at TEXT -- NULL if the value never expires
+	);
+	CREATE INDEX state_expires_at ON state (expires_at) WHERE expires_at IS NOT NULL;
+
+	CREATE TABLE history (
+		id INTEGER PRIMARY KEY,
+		key TEXT NOT NULL,
+		value REAL NOT NULL,
+		at TEXT NOT NULL
+	);
+	CREATE INDEX history_key_at ON history (key, at);
+	CREATE INDEX history_at ON history (at);`,
+
+	// 2: recordSample finds the oldest sample to keep for a key by id, on every write
+	`CREATE INDEX history_key_id ON history (key, id);`,
+}
+
+func migrate(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TEXT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	var current int
+	err = db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("database is at schema version %d, but this build only knows about %d", current, len(migrations))
+	}
+
+	for idx := current; idx < len(migrations); idx++ {
+		version := idx + 1
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[idx]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed: %v", version, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, version, formatTime(time.Now())); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,454 @@
+package sqlitestate
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/yob/home-data/core/homestate"
+	"github.com/yob/home-data/pubsub"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	// how often old history is deleted
+	pruneInterval = 1 * time.Minute
+
+	// fixed width, so times sort correctly as text
+	timeFormat = "2006-01-02T15:04:05.000000000Z07:00"
+)
+
+// State keeps state in a sqlite database, so it survives restarts and can be queried with
+// plain SQL while debugging. For example, the temperature in the kitchen over the last
+// hour:
+//
+//	sqlite3 state.db "SELECT at, value FROM history WHERE key = 'ruuvi.kitchen.temp_celcius' ORDER BY at DESC LIMIT 60"
+//
+// Every write goes straight to disk, there's nothing to flush.
+type State struct {
+	db *sql.DB
+
+	historyRetention  time.Duration
+	historyMaxSamples int
+	onError           func(error)
+
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func New(dbPath string, opts ...Option) (*State, error) {
+	// WAL lets the sqlite3 shell read while we're writing
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)", dbPath))
+	if err != nil {
+		return nil, err
+	}
+	// a single connection serializes access, which keeps transactions simple and avoids
+	// SQLITE_BUSY. One raspberry pi doesn't need more
+	db.SetMaxOpenConns(1)
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlitestate: unable to migrate %s - %v", dbPath, err)
+	}
+
+	state := &State{
+		db:                db,
+		historyRetention:  DefaultHistoryRetention,
+		historyMaxSamples: DefaultHistoryMaxSamples,
+		stop:              make(chan struct{}),
+		stopped:           make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(state)
+	}
+	go state.pruneLoop()
+	return state, nil
+}
+
+// Close stops pruning history and closes the database. It's safe to call more than once
+func (state *State) Close() error {
+	state.closeOnce.Do(func() {
+		close(state.stop)
+		<-state.stopped
+		state.closeErr = state.db.Close()
+	})
+	return state.closeErr
+}
+
+func (state *State) Read(key string) (string, bool) {
+	if row, err := state.load(key); err == nil {
+		return row.value.String(), true
+	}
+	return "", false
+}
+
+func (state *State) ReadValue(key string) (homestate.Value, bool) {
+	if row, err := state.load(key); err == nil {
+		return row.value, true
+	}
+	return homestate.Value{}, false
+}
+
+func (state *State) ReadFloat64(key string) (float64, error) {
+	row, err := state.load(key)
+	if err != nil {
+		return 0, err
+	}
+	return row.value.Float64()
+}
+
+func (state *State) ReadInt(key string) (int64, error) {
+	row, err := state.load(key)
+	if err != nil {
+		return 0, err
+	}
+	return row.value.Int64()
+}
+
+func (state *State) ReadBool(key string) (bool, error) {
+	row, err := state.load(key)
+	if err != nil {
+		return false, err
+	}
+	return row.value.Bool()
+}
+
+func (state *State) ReadTime(key string) (time.Time, error) {
+	row, err := state.load(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return row.value.Time()
+}
+
+func (state *State) ReadEnum(key string) (string, error) {
+	row, err := state.load(key)
+	if err != nil {
+		return "", err
+	}
+	return row.value.Enum()
+}
+
+// Age returns how long ago key was last stored
+func (state *State) Age(key string) (time.Duration, bool) {
+	if row, err := state.load(key); err == nil {
+		return time.Since(row.metadata.UpdatedAt), true
+	}
+	return 0, false
+}
+
+func (state *State) ReadMetadata(key string) (homestate.Metadata, bool) {
+	if row, err := state.load(key); err == nil {
+		return row.metadata, true
+	}
+	return homestate.Metadata{}, false
+}
+
+func (state *State) ReadOnly() homestate.StateReader {
+	return homestate.NewReadOnly(state)
+}
+
+func (state *State) Keys(pattern string) ([]string, error) {
+	// sqlite has nothing like pubsub.MatchTopic, so the matching is done here
+	rows, err := state.db.Query(`SELECT key FROM state WHERE expires_at IS NULL OR expires_at > ?`, formatTime(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]string, 0)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		if pubsub.MatchTopic(pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Keys are compared byte by byte, so every key starting with prefix sorts between prefix
+// and prefixEnd(prefix). Unlike LIKE or substr, that doesn't care about case or how many
+// bytes a character takes, and it can use the primary key
+func (state *State) ReadPrefix(prefix string) (map[string]homestate.Value, error) {
+	end := prefixEnd(prefix)
+	if end == "" {
+		return state.Snapshot()
+	}
+	return state.values(`SELECT key, kind, value FROM state WHERE key >= ? AND key < ? AND (expires_at IS NULL OR expires_at > ?)`, prefix, end, formatTime(time.Now()))
+}
+
+func (state *State) Snapshot() (map[string]homestate.Value, error) {
+	return state.values(`SELECT key, kind, value FROM state WHERE expires_at IS NULL OR expires_at > ?`, formatTime(time.Now()))
+}
+
+// the smallest string that's bigger than every string starting with prefix, or "" if
+// there isn't one because prefix is empty or all 0xff bytes
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for idx := len(end) - 1; idx >= 0; idx-- {
+		if end[idx] < 0xff {
+			end[idx]++
+			return string(end[:idx+1])
+		}
+	}
+	return ""
+}
+
+func (state *State) Store(key string, value homestate.Value, opts ...homestate.StoreOption) error {
+	options := homestate.NewStoreOptions(opts...)
+	return state.inTx(func(tx *sql.Tx) error {
+		return state.store(tx, key, value, options, time.Now())
+	})
+}
+
+func (state *State) StoreMulti(updates map[string]homestate.Value) error {
+	now := time.Now()
+	return state.inTx(func(tx *sql.Tx) error {
+		for key, value := range updates {
+			if err := state.store(tx, key, value, homestate.StoreOptions{}, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (state *State) CompareAndSwap(key string, old *homestate.Value, new homestate.Value, opts ...homestate.StoreOption) (bool, error) {
+	return state.Apply(homestate.Txn{
+		Conditions: []homestate.Condition{{Key: key, Value: old}},
+		Writes:     []homestate.Write{{Key: key, Value: &new}},
+	}, opts...)
+}
+
+func (state *State) Apply(txn homestate.Txn, opts ...homestate.StoreOption) (bool, error) {
+	for _, write := range txn.Writes {
+		if write.Key == "" {
+			return false, fmt.Errorf("sqlitestate: transaction has a write with no key")
+		}
+	}
+	options := homestate.NewStoreOptions(opts...)
+	now := time.Now()
+
+	applied := false
+	err := state.inTx(func(tx *sql.Tx) error {
+		for _, condition := range txn.Conditions {
+			holds, err := state.holds(tx, condition, now)
+			if err != nil || !holds {
+				return err
+			}
+		}
+		for _, write := range txn.Writes {
+			if write.Value == nil {
+				if err := remove(tx, write.Key); err != nil {
+					return err
+				}
+				continue
+			}
+			writeOptions := options
+			writeOptions.TTL = write.TTL
+			writeOptions.Unit = write.Unit
+			writeOptions.DeviceClass = write.DeviceClass
+			if err := state.store(tx, write.Key, *write.Value, writeOptions, now); err != nil {
+				return err
+			}
+		}
+		applied = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return applied, nil
+}
+
+func (state *State) Remove(key string) error {
+	return state.inTx(func(tx *sql.Tx) error {
+		return remove(tx, key)
+	})
+}
+
+// Expire removes every key with a TTL that has lapsed by now, and returns the removed keys
+// along with the values they had
+func (state *State) Expire(now time.Time) map[string]homestate.Value {
+	expired := make(map[string]homestate.Value)
+	err := state.inTx(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT key, kind, value FROM state WHERE expires_at <= ?`, formatTime(now))
+		if err != nil {
+			return err
+		}
+		values, err := scanValues(rows)
+		if err != nil {
+			return err
+		}
+		for key := range values {
+			if err := remove(tx, key); err != nil {
+				return err
+			}
+		}
+		expired = values
+		return nil
+	})
+	if err != nil {
+		return map[string]homestate.Value{}
+	}
+	return expired
+}
+
+// The unit and device class are kept from the previous value unless new ones are
+// provided, plenty of updates don't include them
+func (state *State) store(tx *sql.Tx, key string, value homestate.Value, options homestate.StoreOptions, now time.Time) error {
+	var expiresAt any
+	if options.TTL > 0 {
+		expiresAt = formatTime(now.Add(options.TTL))
+	}
+	var number any
+	if n, ok := value.Numeric(); ok {
+		number = n
+	}
+
+	_, err := tx.Exec(`INSERT INTO state (key, kind, value, number, unit, device_class, source, updated_at, update_count, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, 1, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			kind = excluded.kind,
+			value = excluded.value,
+			number = excluded.number,
+			unit = CASE WHEN excluded.unit != '' THEN excluded.unit ELSE state.unit END,
+			device_class = CASE WHEN excluded.device_class != '' THEN excluded.device_class ELSE state.device_class END,
+			source = excluded.source,
+			updated_at = excluded.updated_at,
+			update_count = state.update_count + 1,
+			expires_at = excluded.expires_at`,
+		key, value.Kind().String(), value.String(), number, options.Unit, options.DeviceClass, options.Source, formatTime(now), expiresAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, ok := value.Numeric(); ok {
+		return state.recordSample(tx, key, n, now)
+	}
+	return nil
+}
+
+// Only called inside a transaction. Expired keys count as missing, like they do for
+// readers
+func (state *State) holds(tx *sql.Tx, condition homestate.Condition, now time.Time) (bool, error) {
+	var kind, raw string
+	err := tx.QueryRow(`SELECT kind, value FROM state WHERE key = ? AND (expires_at IS NULL OR expires_at > ?)`, condition.Key, formatTime(now)).Scan(&kind, &raw)
+	if err == sql.ErrNoRows {
+		return condition.Value == nil, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if condition.Value == nil {
+		return false, nil
+	}
+	value, err := parseValue(kind, raw)
+	if err != nil {
+		return false, err
+	}
+	return value.Equal(*condition.Value), nil
+}
+
+func remove(tx *sql.Tx, key string) error {
+	if _, err := tx.Exec(`DELETE FROM state WHERE key = ?`, key); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`DELETE FROM history WHERE key = ?`, key)
+	return err
+}
+
+type row struct {
+	value    homestate.Value
+	metadata homestate.Metadata
+}
+
+// expired keys are hidden from readers even before Expire removes them. The error wraps
+// homestate.ErrNotFound if the key isn't there
+func (state *State) load(key string) (row, error) {
+	var kind, raw, updatedAt string
+	var result row
+	err := state.db.QueryRow(`SELECT kind, value, unit, device_class, source, updated_at, update_count
+		FROM state WHERE key = ? AND (expires_at IS NULL OR expires_at > ?)`, key, formatTime(time.Now())).
+		Scan(&kind, &raw, &result.metadata.Unit, &result.metadata.DeviceClass, &result.metadata.Source, &updatedAt, &result.metadata.UpdateCount)
+	if err == sql.ErrNoRows {
+		return row{}, fmt.Errorf("%w: %s", homestate.ErrNotFound, key)
+	}
+	if err != nil {
+		return row{}, err
+	}
+
+	result.value, err = parseValue(kind, raw)
+	if err != nil {
+		return row{}, fmt.Errorf("sqlitestate: %s has an invalid value - %v", key, err)
+	}
+	result.metadata.UpdatedAt, err = time.Parse(timeFormat, updatedAt)
+	if err != nil {
+		return row{}, fmt.Errorf("sqlitestate: %s has an invalid updated_at - %v", key, err)
+	}
+	return result, nil
+}
+
+func (state *State) values(query string, args ...any) (map[string]homestate.Value, error) {
+	rows, err := state.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanValues(rows)
+}
+
+// reads rows of key, kind and value, then closes rows
+func scanValues(rows *sql.Rows) (map[string]homestate.Value, error) {
+	defer rows.Close()
+
+	result := make(map[string]homestate.Value)
+	for rows.Next() {
+		var key, kind, raw string
+		if err := rows.Scan(&key, &kind, &raw); err != nil {
+			return nil, err
+		}
+		value, err := parseValue(kind, raw)
+		if err != nil {
+			return nil, fmt.Errorf("sqlitestate: %s has an invalid value - %v", key, err)
+		}
+		result[key] = value
+	}
+	return result, rows.Err()
+}
+
+// run fn in a transaction, committing if it returns nil and rolling back otherwise
+func (state *State) inTx(fn func(*sql.Tx) error) error {
+	tx, err := state.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func parseValue(kind string, raw string) (homestate.Value, error) {
+	parsedKind, err := homestate.ParseKind(kind)
+	if err != nil {
+		return homestate.Value{}, err
+	}
+	return homestate.ParseValue(parsedKind, raw)
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(timeFormat)
+}
@@ -0,0 +1,305 @@
+package sqlitestate
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yob/home-data/core/homestate"
+)
+
+func newTestState(t *testing.T, opts ...Option) *State {
+	t.Helper()
+	state, err := New(filepath.Join(t.TempDir(), "state.db"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { state.Close() })
+	return state
+}
+
+func schemaVersion(t *testing.T, db *sql.DB) int {
+	t.Helper()
+	var version int
+	if err := db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func TestMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	state, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := schemaVersion(t, state.db); got != len(migrations) {
+		t.Errorf("new database is at version %d, want %d", got, len(migrations))
+	}
+	state.Store("ruuvi.kitchen.temp_celcius", homestate.FloatValue(21))
+	state.Close()
+
+	// opening it again doesn't apply anything twice, or lose anything
+	state, err = New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := schemaVersion(t, state.db); got != len(migrations) {
+		t.Errorf("reopened database is at version %d, want %d", got, len(migrations))
+	}
+	if value, err := state.ReadFloat64("ruuvi.kitchen.temp_celcius"); err != nil || value != 21 {
+		t.Errorf("expected the value to survive reopening, got %v %v", value, err)
+	}
+
+	// a database from a newer build is refused rather than changed
+	state.db.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, len(migrations)+1, formatTime(time.Now()))
+	state.Close()
+	if _, err := New(path); err == nil || !strings.Contains(err.Error(), "only knows about") {
+		t.Errorf("expected a newer schema to be refused, got %v", err)
+	}
+}
+
+func TestMigrateFromVersionOne(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	state, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// roll back to how the first release left the database
+	state.db.Exec(`DROP INDEX history_key_id`)
+	state.db.Exec(`DELETE FROM schema_migrations WHERE version > 1`)
+	state.Close()
+
+	state, err = New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+	var count int
+	state.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = 'history_key_id'`).Scan(&count)
+	if count != 1 {
+		t.Error("expected migration 2 to add history_key_id")
+	}
+}
+
+func TestStoreAndRead(t *testing.T) {
+	state := newTestState(t)
+	now := time.Date(2026, 1, 2, 3, 4, 5, 6, time.UTC)
+	values := map[string]homestate.Value{
+		"float":  homestate.FloatValue(1.5),
+		"int":    homestate.IntValue(-3),
+		"bool":   homestate.BoolValue(true),
+		"string": homestate.StringValue("hello"),
+		"enum":   homestate.EnumValue("cool"),
+		"time":   homestate.TimeValue(now),
+	}
+	for key, value := range values {
+		if err := state.Store(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key, want := range values {
+		if got, ok := state.ReadValue(key); !ok || !got.Equal(want) {
+			t.Errorf("ReadValue(%s) = %v %v, want %v", key, got, ok, want)
+		}
+	}
+	if _, err := state.ReadFloat64("missing"); !errors.Is(err, homestate.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for a missing key, got %v", err)
+	}
+
+	// the unit is kept when an update doesn't include one
+	state.Store("float", homestate.FloatValue(2), homestate.WithUnit("W"), homestate.WithSource("fronius"))
+	state.Store("float", homestate.FloatValue(3))
+	metadata, _ := state.ReadMetadata("float")
+	if metadata.Unit != "W" || metadata.UpdateCount != 3 {
+		t.Errorf("unexpected metadata %+v", metadata)
+	}
+}
+
+func TestReadPrefix(t *testing.T) {
+	state := newTestState(t)
+	for _, key := range []string{
+		"ruuvi.kitchen.temp", "ruuvi.kitchen.humidity", "ruuvi.kitchenette.temp",
+		"ruuvi.küche.temp", "ruuvi.küchen.temp", "ruuvi.kz", "Ruuvi.kitchen.temp", "ruuvj",
+	} {
+		state.Store(key, homestate.FloatValue(1))
+	}
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"ruuvi.kitchen.", []string{"ruuvi.kitchen.humidity", "ruuvi.kitchen.temp"}},
+		{"ruuvi.kitchen", []string{"ruuvi.kitchen.humidity", "ruuvi.kitchen.temp", "ruuvi.kitchenette.temp"}},
+		// ü is two bytes, but one character to sqlite
+		{"ruuvi.küche.", []string{"ruuvi.küche.temp"}},
+		{"ruuvi.kü", []string{"ruuvi.küche.temp", "ruuvi.küchen.temp"}},
+		{"Ruuvi", []string{"Ruuvi.kitchen.temp"}},
+		{"nothing", []string{}},
+		{"", []string{"Ruuvi.kitchen.temp", "ruuvi.kitchen.humidity", "ruuvi.kitchen.temp", "ruuvi.kitchenette.temp", "ruuvi.kz", "ruuvi.küche.temp", "ruuvi.küchen.temp", "ruuvj"}},
+	}
+	for _, test := range tests {
+		values, err := state.ReadPrefix(test.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, 0, len(values))
+		for key := range values {
+			got = append(got, key)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, test.want) {
+			t.Errorf("ReadPrefix(%s) = %v, want %v", test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"abc", "abd"},
+		{"a\xff", "b"},
+		{"\xff\xff", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := prefixEnd(test.prefix); got != test.want {
+			t.Errorf("prefixEnd(%q) = %q, want %q", test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestKeys(t *testing.T) {
+	state := newTestState(t)
+	for _, key := range []string{"ruuvi.kitchen.temp", "ruuvi.outside.temp", "ruuvi.kitchen.humidity", "daikin.study.power"} {
+		state.Store(key, homestate.FloatValue(1))
+	}
+	keys, err := state.Keys("ruuvi.*.temp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ruuvi.kitchen.temp", "ruuvi.outside.temp"}; !slices.Equal(keys, want) {
+		t.Errorf("Keys(ruuvi.*.temp) = %v, want %v", keys, want)
+	}
+}
+
+// a database that can't be read shouldn't look like an empty one
+func TestReadErrors(t *testing.T) {
+	state := newTestState(t)
+	state.Store("ruuvi.kitchen.temp", homestate.FloatValue(1))
+	state.Close()
+
+	if keys, err := state.Keys("#"); err == nil {
+		t.Errorf("Keys on a closed database = %v, expected an error", keys)
+	}
+	if values, err := state.ReadPrefix("ruuvi."); err == nil {
+		t.Errorf("ReadPrefix on a closed database = %v, expected an error", values)
+	}
+	if values, err := state.Snapshot(); err == nil {
+		t.Errorf("Snapshot on a closed database = %v, expected an error", values)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	state := newTestState(t)
+	state.Store("presence", homestate.BoolValue(true), homestate.WithTTL(time.Hour))
+	state.Store("forever", homestate.BoolValue(true))
+
+	expired := state.Expire(time.Now().Add(2 * time.Hour))
+	if !reflect.DeepEqual(expired, map[string]homestate.Value{"presence": homestate.BoolValue(true)}) {
+		t.Errorf("unexpected expired keys %v", expired)
+	}
+	if _, ok := state.ReadValue("presence"); ok {
+		t.Error("expected presence to be removed")
+	}
+	if _, ok := state.ReadValue("forever"); !ok {
+		t.Error("expected a key without a ttl to be kept")
+	}
+}
+
+func TestApply(t *testing.T) {
+	state := newTestState(t)
+	first := homestate.TimeValue(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	second := homestate.TimeValue(time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC))
+
+	// missing is a condition too
+	applied, err := state.CompareAndSwap("rule_last_at", nil, first)
+	if err != nil || !applied {
+		t.Fatalf("expected the first swap to apply, got %v %v", applied, err)
+	}
+	applied, err = state.CompareAndSwap("rule_last_at", nil, second)
+	if err != nil || applied {
+		t.Fatalf("expected a swap from missing to fail once the key exists, got %v %v", applied, err)
+	}
+
+	// nothing is written unless every condition holds
+	applied, err = state.Apply(homestate.Txn{
+		Conditions: []homestate.Condition{{Key: "rule_last_at", Value: &first}, {Key: "other", Value: &first}},
+		Writes:     []homestate.Write{{Key: "rule_last_at", Value: &second}},
+	})
+	if err != nil || applied {
+		t.Fatalf("expected the transaction not to apply, got %v %v", applied, err)
+	}
+	if value, _ := state.ReadValue("rule_last_at"); !value.Equal(first) {
+		t.Errorf("rule_last_at changed to %v", value)
+	}
+
+	// a nil value deletes
+	applied, err = state.Apply(homestate.Txn{
+		Conditions: []homestate.Condition{{Key: "rule_last_at", Value: &first}},
+		Writes:     []homestate.Write{{Key: "rule_last_at"}},
+	})
+	if err != nil || !applied {
+		t.Fatalf("expected the delete to apply, got %v %v", applied, err)
+	}
+	if _, ok := state.ReadValue("rule_last_at"); ok {
+		t.Error("expected rule_last_at to be deleted")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	state := newTestState(t, WithHistory(time.Hour, 3))
+	for _, value := range []float64{5, 1, 4, 2, 3} {
+		state.Store("fronius.inverter.grid_draw_watts", homestate.FloatValue(value))
+	}
+	// only the newest 3 are kept
+	var count int
+	state.db.QueryRow(`SELECT COUNT(*) FROM history WHERE key = ?`, "fronius.inverter.grid_draw_watts").Scan(&count)
+	if count != 3 {
+		t.Errorf("expected 3 samples, got %d", count)
+	}
+
+	samples := state.LastN("fronius.inverter.grid_draw_watts", 10)
+	got := make([]float64, 0, len(samples))
+	for _, sample := range samples {
+		got = append(got, sample.Value)
+	}
+	if want := []float64{4, 2, 3}; !slices.Equal(got, want) {
+		t.Errorf("LastN = %v, want %v", got, want)
+	}
+	if min, ok := state.Min("fronius.inverter.grid_draw_watts", time.Hour); !ok || min != 2 {
+		t.Errorf("Min = %v %v, want 2", min, ok)
+	}
+	if max, ok := state.Max("fronius.inverter.grid_draw_watts", time.Hour); !ok || max != 4 {
+		t.Errorf("Max = %v %v, want 4", max, ok)
+	}
+	if mean, ok := state.Mean("fronius.inverter.grid_draw_watts", time.Hour); !ok || mean != 3 {
+		t.Errorf("Mean = %v %v, want 3", mean, ok)
+	}
+	if _, ok := state.Min("missing", time.Hour); ok {
+		t.Error("expected no Min for a key without history")
+	}
+
+	// removing a key removes its history
+	state.Remove("fronius.inverter.grid_draw_watts")
+	if samples := state.LastN("fronius.inverter.grid_draw_watts", 10); len(samples) != 0 {
+		t.Errorf("expected no history after removing the key, got %v", samples)
+	}
+}
@@ -1,7 +1,10 @@
 package statebus
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"time"
 
 	"github.com/yob/home-data/core/homestate"
 	"github.com/yob/home-data/core/logging"
@@ -10,37 +13,247 @@ import (
 
 const (
 	updateBufferSize = 10
+
+	// how often to look for keys with a TTL that has lapsed
+	expireInterval = 5 * time.Second
 )
 
+// state:update and state:changed carry typed payloads, registered so the journal can
+// decode them
+func init() {
+	if err := pubsub.RegisterTopic[homestate.Update]("state:update"); err != nil {
+		panic(err)
+	}
+	if err := pubsub.RegisterTopic[homestate.Change]("state:changed"); err != nil {
+		panic(err)
+	}
+	if err := pubsub.RegisterTopic[homestate.Swap]("state:cas"); err != nil {
+		panic(err)
+	}
+	if err := pubsub.RegisterTopic[homestate.Txn]("state:txn"); err != nil {
+		panic(err)
+	}
+}
+
+// Init applies state changes until the bus is shutdown. It doesn't stop when adapters are
+// told to stop, so their final updates are still applied.
+//
+// Whenever a value changes, a homestate.Change is published to state:changed. Subscribe to
+// it with pubsub.Subscribe[homestate.Change] to react to changes as they happen, instead
+// of checking state every minute.
+//
+// Adapters that need to check a value before changing it can use CompareAndSwap and Apply,
+// which wait until the change has been made.
 func Init(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.State) {
-	subStateUpdate, _ := bus.Subscribe("state:update")
+	// if we fall behind, there's no point applying stale values for a key that's since
+	// been updated again
+	subStateUpdate, _ := bus.Subscribe(context.Background(), "state:update", pubsub.WithDropPolicy(pubsub.CoalesceByKey))
 	defer subStateUpdate.Close()
 
-	subStateDelete, _ := bus.Subscribe("state:delete")
+	subStateDelete, _ := bus.Subscribe(context.Background(), "state:delete")
 	defer subStateDelete.Close()
 
+	// requests are never coalesced and are worth waiting a moment for, someone is waiting
+	// for each reply
+	subStateTxn, _ := bus.Subscribe(context.Background(), "state:txn", pubsub.WithDropPolicy(pubsub.Block))
+	defer subStateTxn.Close()
+
+	subStateSwap, _ := bus.Subscribe(context.Background(), "state:cas", pubsub.WithDropPolicy(pubsub.Block))
+	defer subStateSwap.Close()
+
+	expireTicker := time.NewTicker(expireInterval)
+	defer expireTicker.Stop()
+
 	for {
 		select {
-		case event := <-subStateUpdate.Ch:
-			if event.Type == "key-value" {
-				stateUpdate(logger, state, event.Key, event.Value)
+		case event, ok := <-subStateUpdate.Ch:
+			if !ok {
+				return
+			}
+			switch event.Type {
+			case "key-value":
+				// untyped updates from older code
+				stateUpdate(bus, logger, state, event, homestate.Update{Key: event.Key, Value: homestate.InferValue(event.Value)})
+			case "typed":
+				if update, ok := event.Payload.(homestate.Update); ok {
+					stateUpdate(bus, logger, state, event, update)
+				}
+			}
+		case event, ok := <-subStateDelete.Ch:
+			if !ok {
+				return
+			}
+			// expired keys were removed before the delete was published, and the key might
+			// have been stored again since
+			if event.Type == "value" && event.Source != bus.Source() {
+				stateDelete(bus, logger, state, event)
 			}
-		case event := <-subStateDelete.Ch:
-			if event.Type == "value" {
-				stateDelete(logger, state, event.Value)
+		case event, ok := <-subStateTxn.Ch:
+			if !ok {
+				return
+			}
+			if txn, ok := event.Payload.(homestate.Txn); ok {
+				stateTxn(bus, logger, state, event, txn)
+			}
+		case event, ok := <-subStateSwap.Ch:
+			if !ok {
+				return
+			}
+			if swap, ok := event.Payload.(homestate.Swap); ok {
+				stateTxn(bus, logger, state, event, homestate.Txn{
+					Conditions: []homestate.Condition{{Key: swap.Key, Value: swap.Old}},
+					Writes: []homestate.Write{{
+						Key:         swap.Key,
+						Value:       &swap.New,
+						TTL:         swap.TTL,
+						Unit:        swap.Unit,
+						DeviceClass: swap.DeviceClass,
+					}},
+				})
+			}
+		case now := <-expireTicker.C:
+			stateExpire(bus, logger, state, now)
+		}
+	}
+}
+
+func stateUpdate(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.State, event pubsub.EventData, update homestate.Update) {
+	old, existed := state.ReadValue(update.Key)
+	err := state.Store(update.Key, update.Value,
+		homestate.WithTTL(update.TTL),
+		homestate.WithUnit(update.Unit),
+		homestate.WithDeviceClass(update.DeviceClass),
+		homestate.WithSource(event.Source),
+	)
+	if err != nil {
+		logger.Error(fmt.Sprintf("statebus: unable to set %s from %s - %v", update.Key, event.Source, err))
+		return
+	}
+
+	logger.Debug(fmt.Sprintf("set %s to %s %s (ttl: %s source: %s seq: %d published: %s)", update.Key, update.Value.Kind(), update.Value, update.TTL, event.Source, event.Seq, event.PublishedAt.Format(time.RFC3339Nano)))
+
+	if existed && old.Equal(update.Value) {
+		return
+	}
+	publishChange(bus, homestate.Change{
+		Key:   update.Key,
+		Old:   old,
+		New:   update.Value,
+		Added: !existed,
+	})
+}
+
+func stateDelete(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.State, event pubsub.EventData) {
+	old, existed := state.ReadValue(event.Value)
+	if err := state.Remove(event.Value); err != nil {
+		logger.Error(fmt.Sprintf("statebus: unable to delete %s from %s - %v", event.Value, event.Source, err))
+		return
+	}
+
+	logger.Debug(fmt.Sprintf("delete %s (source: %s seq: %d published: %s)", event.Value, event.Source, event.Seq, event.PublishedAt.Format(time.RFC3339Nano)))
+
+	if existed {
+		publishChange(bus, homestate.Change{
+			Key:     event.Value,
+			Old:     old,
+			Deleted: true,
+		})
+	}
+}
+
+// apply a transaction, and reply to let the requester know if it was applied
+func stateTxn(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.State, event pubsub.EventData, txn homestate.Txn) {
+	// remember what the keys held before, so we can tell which ones changed
+	type before struct {
+		value   homestate.Value
+		existed bool
+	}
+	keys := make([]string, 0, len(txn.Writes))
+	old := make(map[string]before)
+	for _, write := range txn.Writes {
+		if _, ok := old[write.Key]; ok {
+			continue
+		}
+		value, existed := state.ReadValue(write.Key)
+		old[write.Key] = before{value: value, existed: existed}
+		keys = append(keys, write.Key)
+	}
+
+	applied, err := state.Apply(txn, homestate.WithSource(event.Source))
+	if err != nil {
+		logger.Error(fmt.Sprintf("statebus: unable to apply transaction from %s - %v", event.Source, err))
+		bus.Reply(event, pubsub.NewReplyEvent(err))
+		return
+	}
+
+	logger.Debug(fmt.Sprintf("transaction on %v applied: %t (source: %s seq: %d published: %s)", keys, applied, event.Source, event.Seq, event.PublishedAt.Format(time.RFC3339Nano)))
+
+	if applied {
+		for _, key := range keys {
+			value, exists := state.ReadValue(key)
+			was := old[key]
+			switch {
+			case !was.existed && exists:
+				publishChange(bus, homestate.Change{Key: key, New: value, Added: true})
+			case was.existed && !exists:
+				publishChange(bus, homestate.Change{Key: key, Old: was.value, Deleted: true})
+			case was.existed && exists && !was.value.Equal(value):
+				publishChange(bus, homestate.Change{Key: key, Old: was.value, New: value})
 			}
 		}
 	}
+	bus.Reply(event, pubsub.NewTypedEvent(homestate.TxnResult{Applied: applied}))
+}
+
+// remove keys that haven't been updated within their TTL, and let everyone else know
+func stateExpire(bus *pubsub.Pubsub, logger *logging.Logger, state homestate.State, now time.Time) {
+	expired := state.Expire(now)
+	keys := make([]string, 0, len(expired))
+	for key := range expired {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		logger.Debug(fmt.Sprintf("expired %s", key))
+		bus.Publish("state:delete", pubsub.NewValueEvent(key))
+		publishChange(bus, homestate.Change{
+			Key:     key,
+			Old:     expired[key],
+			Deleted: true,
+		})
+	}
 }
 
-func stateUpdate(logger *logging.Logger, state homestate.State, key string, value string) {
-	state.Store(key, value)
+func publishChange(bus *pubsub.Pubsub, change homestate.Change) {
+	if err := pubsub.Publish(bus, "state:changed", change); err != nil {
+		// only possible if someone bound state:changed to another type, and init() would
+		// have panicked first
+		panic(err)
+	}
+}
 
-	logger.Debug(fmt.Sprintf("set %s to %s", key, value))
+// CompareAndSwap asks statebus to make swap, and waits until it has. It returns false if
+// the key didn't hold swap.Old. Updates published to state:update before calling this
+// might not have been applied yet, so don't mix them for the same key.
+func CompareAndSwap(ctx context.Context, bus *pubsub.Pubsub, swap homestate.Swap) (bool, error) {
+	return request(ctx, bus, "state:cas", swap)
 }
 
-func stateDelete(logger *logging.Logger, state homestate.State, key string) {
-	state.Remove(key)
+// Apply asks statebus to apply txn, and waits until it has. It returns false if any of
+// the conditions didn't hold, and nothing was written
+func Apply(ctx context.Context, bus *pubsub.Pubsub, txn homestate.Txn) (bool, error) {
+	return request(ctx, bus, "state:txn", txn)
+}
 
-	logger.Debug(fmt.Sprintf("delete %s", key))
+func request[T any](ctx context.Context, bus *pubsub.Pubsub, topic string, payload T) (bool, error) {
+	reply, err := pubsub.Request(ctx, bus, topic, payload)
+	if err != nil {
+		return false, err
+	}
+	result, ok := reply.Payload.(homestate.TxnResult)
+	if !ok {
+		return false, fmt.Errorf("statebus: unexpected reply to %s", topic)
+	}
+	return result.Applied, nil
 }
@@ -0,0 +1,233 @@
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yob/home-data/core/config"
+	"github.com/yob/home-data/core/homestate"
+	"github.com/yob/home-data/core/logging"
+	"github.com/yob/home-data/pubsub"
+)
+
+// how long Apply waits for adapters to stop. One that takes longer isn't started again
+// until a later Apply finds it has stopped, or two could be controlling the same device
+const stopTimeout = 10 * time.Second
+
+// InitFunc is the signature of every adapter's Init
+type InitFunc func(context.Context, *pubsub.Pubsub, *logging.Logger, homestate.StateReader, *config.ConfigSection)
+
+// Reload is published on config:reloaded each time the config file is reloaded. The
+// sections are named the way they are in the config file
+type Reload struct {
+	Started   []string
+	Stopped   []string
+	Restarted []string
+
+	// set when some or all of the new config couldn't be used. When the file is invalid
+	// nothing is changed. When an old adapter was slow to stop, its section isn't started
+	// and is listed in Stopped instead of Restarted
+	Error string
+}
+
+func init() {
+	if err := pubsub.RegisterTopic[Reload]("config:reloaded"); err != nil {
+		panic(err)
+	}
+}
+
+// Supervisor runs an adapter for each section of the config file, and can apply a new
+// set of sections without disturbing the adapters whose config hasn't changed. That way
+// a reload doesn't lose anything an adapter is keeping in memory.
+type Supervisor struct {
+	ctx   context.Context
+	bus   *pubsub.Pubsub
+	state homestate.StateReader
+	inits map[string]InitFunc
+
+	mu      sync.Mutex
+	running map[string]*runningAdapter
+	wg      sync.WaitGroup
+
+	// adapters that were told to stop but hadn't by the end of an Apply, by section name
+	stopping    map[string]*runningAdapter
+	stopTimeout time.Duration
+}
+
+type runningAdapter struct {
+	section *config.ConfigSection
+	logger  *logging.Logger
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// New returns a supervisor that starts adapters with the functions in inits, keyed by the
+// name used in adapter = "...". Every adapter is stopped when ctx is cancelled
+func New(ctx context.Context, bus *pubsub.Pubsub, state homestate.StateReader, inits map[string]InitFunc) *Supervisor {
+	return &Supervisor{
+		ctx:         ctx,
+		bus:         bus,
+		state:       state,
+		inits:       inits,
+		running:     make(map[string]*runningAdapter),
+		stopping:    make(map[string]*runningAdapter),
+		stopTimeout: stopTimeout,
+	}
+}
+
+// Apply makes sections the set of running adapters. Sections are matched to running
+// adapters by name: new ones are started, missing ones are stopped, and any that have
+// changed are stopped and started again with the new config. Apply returns once the
+// stopped adapters have finished, or the stop timeout has passed.
+func (s *Supervisor) Apply(sections []*config.ConfigSection) Reload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := Reload{
+		Started:   make([]string, 0),
+		Stopped:   make([]string, 0),
+		Restarted: make([]string, 0),
+	}
+	// shutting down, the adapters are already stopping
+	if s.ctx.Err() != nil {
+		return result
+	}
+
+	wanted := make(map[string]*config.ConfigSection)
+	for _, section := range sections {
+		wanted[section.Name()] = section
+	}
+
+	// adapters that were slow to stop during an earlier Apply might have finished by now
+	for name, old := range s.stopping {
+		select {
+		case <-old.done:
+			delete(s.stopping, name)
+		default:
+		}
+	}
+
+	// stop everything that's going away or changing first, so the new adapters don't
+	// overlap with the old ones
+	stopping := make([]*runningAdapter, 0)
+	changed := make(map[string]bool)
+	for name, running := range s.running {
+		section, ok := wanted[name]
+		if ok && section.Equal(running.section) {
+			continue
+		}
+		running.cancel()
+		stopping = append(stopping, running)
+		delete(s.running, name)
+		if ok {
+			changed[name] = true
+		} else {
+			result.Stopped = append(result.Stopped, name)
+		}
+	}
+	for _, running := range s.waitForStop(stopping) {
+		s.stopping[running.section.Name()] = running
+	}
+
+	notStarted := make([]string, 0)
+	for _, section := range sections {
+		name := section.Name()
+		if _, ok := s.running[name]; ok {
+			continue
+		}
+		if _, ok := s.stopping[name]; ok {
+			notStarted = append(notStarted, name)
+			if changed[name] {
+				result.Stopped = append(result.Stopped, name)
+			}
+			continue
+		}
+		if changed[name] {
+			result.Restarted = append(result.Restarted, name)
+		} else {
+			result.Started = append(result.Started, name)
+		}
+		s.start(section)
+	}
+	if len(notStarted) > 0 {
+		sort.Strings(notStarted)
+		result.Error = fmt.Sprintf("not started, the old adapter hasn't stopped yet: %s. Reload again once it has", strings.Join(notStarted, ", "))
+	}
+
+	sort.Strings(result.Started)
+	sort.Strings(result.Stopped)
+	sort.Strings(result.Restarted)
+	return result
+}
+
+// Wait blocks until every adapter has returned. Call it after cancelling the context
+// given to New
+func (s *Supervisor) Wait() {
+	// an Apply that's half way through could still be starting adapters
+	s.mu.Lock()
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Supervisor) start(section *config.ConfigSection) {
+	adapterName, _ := section.GetString("adapter")
+	bus := s.bus.WithSource(adapterSource(adapterName, section))
+	logger := logging.NewLogger(bus)
+
+	init, ok := s.inits[adapterName]
+	if !ok {
+		logger.Fatal(fmt.Sprintf("adapter '%s' not recognised", adapterName))
+		return
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	running := &runningAdapter{
+		section: section,
+		logger:  logger,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	s.running[section.Name()] = running
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(running.done)
+		init(ctx, bus, logger, s.state, section)
+	}()
+}
+
+// waitForStop returns the adapters that haven't stopped by the timeout
+func (s *Supervisor) waitForStop(stopping []*runningAdapter) []*runningAdapter {
+	timeout := time.After(s.stopTimeout)
+	for idx, running := range stopping {
+		select {
+		case <-running.done:
+		case <-timeout:
+			stuck := make([]*runningAdapter, 0)
+			for _, running := range stopping[idx:] {
+				select {
+				case <-running.done:
+				default:
+					running.logger.Error(fmt.Sprintf("supervisor: %s didn't stop within %s, not starting it again until it has", running.section.Name(), s.stopTimeout))
+					stuck = append(stuck, running)
+				}
+			}
+			return stuck
+		}
+	}
+	return nil
+}
+
+// The source stamped on events published by an adapter. Adapters that can be configured
+// more than once have a name, and including it makes it possible to tell them apart
+func adapterSource(adapterName string, section *config.ConfigSection) string {
+	if name, err := section.GetString("name"); err == nil {
+		return fmt.Sprintf("%s.%s", adapterName, name)
+	}
+	return adapterName
+}
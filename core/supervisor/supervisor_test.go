@@ -0,0 +1,187 @@
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yob/home-data/core/config"
+	"github.com/yob/home-data/core/homestate"
+	"github.com/yob/home-data/core/logging"
+	"github.com/yob/home-data/pubsub"
+)
+
+func sections(t *testing.T, contents string) []*config.ConfigSection {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configFile, err := config.NewConfigFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return configFile.AdapterSections()
+}
+
+// an adapter that reports when it starts and stops, and runs until it's cancelled
+func fakeAdapter(events chan<- string) InitFunc {
+	return func(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader, section *config.ConfigSection) {
+		setting, _ := section.GetInt("setting")
+		events <- fmt.Sprintf("start %s %d", section.Name(), setting)
+		<-ctx.Done()
+		events <- fmt.Sprintf("stop %s", section.Name())
+	}
+}
+
+// the next n events, sorted because adapters start and stop concurrently
+func nextEvents(t *testing.T, events <-chan string, n int) []string {
+	t.Helper()
+	result := make([]string, 0, n)
+	for len(result) < n {
+		select {
+		case event := <-events:
+			result = append(result, event)
+		case <-time.After(time.Second):
+			t.Fatalf("expected %d events, got %v", n, result)
+		}
+	}
+	slices.Sort(result)
+	return result
+}
+
+func expectNoEvents(t *testing.T, events <-chan string) {
+	t.Helper()
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event %s", event)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func expectReload(t *testing.T, got Reload, started, stopped, restarted []string) {
+	t.Helper()
+	if !slices.Equal(got.Started, started) || !slices.Equal(got.Stopped, stopped) || !slices.Equal(got.Restarted, restarted) || got.Error != "" {
+		t.Errorf("got started %v stopped %v restarted %v error %q, want started %v stopped %v restarted %v",
+			got.Started, got.Stopped, got.Restarted, got.Error, started, stopped, restarted)
+	}
+}
+
+func TestApply(t *testing.T) {
+	ps := pubsub.NewPubsub()
+	go ps.Run()
+	defer ps.Shutdown(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan string, 100)
+	s := New(ctx, ps, nil, map[string]InitFunc{"fake": fakeAdapter(events)})
+
+	// added, and listed in order of name whatever order they're in the file
+	result := s.Apply(sections(t, `
+[c]
+adapter = "fake"
+setting = 1
+[a]
+adapter = "fake"
+setting = 1
+[b]
+adapter = "fake"
+setting = 1
+`))
+	expectReload(t, result, []string{"a", "b", "c"}, []string{}, []string{})
+	if got, want := nextEvents(t, events, 3), []string{"start a 1", "start b 1", "start c 1"}; !slices.Equal(got, want) {
+		t.Errorf("events %v, want %v", got, want)
+	}
+
+	// nothing has changed, so nothing is disturbed
+	result = s.Apply(sections(t, `
+[a]
+adapter = "fake"
+setting = 1
+[b]
+adapter = "fake"
+setting = 1
+[c]
+adapter = "fake"
+setting = 1
+`))
+	expectReload(t, result, []string{}, []string{}, []string{})
+	expectNoEvents(t, events)
+
+	// b changes, c is removed and d is added
+	result = s.Apply(sections(t, `
+[a]
+adapter = "fake"
+setting = 1
+[b]
+adapter = "fake"
+setting = 2
+[d]
+adapter = "fake"
+setting = 1
+`))
+	expectReload(t, result, []string{"d"}, []string{"c"}, []string{"b"})
+	// the old adapters have stopped before the new ones start
+	if got, want := nextEvents(t, events, 2), []string{"stop b", "stop c"}; !slices.Equal(got, want) {
+		t.Errorf("events %v, want %v", got, want)
+	}
+	if got, want := nextEvents(t, events, 2), []string{"start b 2", "start d 1"}; !slices.Equal(got, want) {
+		t.Errorf("events %v, want %v", got, want)
+	}
+
+	cancel()
+	s.Wait()
+	if got, want := nextEvents(t, events, 3), []string{"stop a", "stop b", "stop d"}; !slices.Equal(got, want) {
+		t.Errorf("events %v, want %v", got, want)
+	}
+}
+
+func TestApplyDoesNotOverlapASlowAdapter(t *testing.T) {
+	ps := pubsub.NewPubsub()
+	go ps.Run()
+	defer ps.Shutdown(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan string, 100)
+	release := make(chan struct{})
+	s := New(ctx, ps, nil, map[string]InitFunc{
+		"slow": func(ctx context.Context, bus *pubsub.Pubsub, logger *logging.Logger, state homestate.StateReader, section *config.ConfigSection) {
+			setting, _ := section.GetInt("setting")
+			events <- fmt.Sprintf("start %d", setting)
+			<-ctx.Done()
+			<-release
+		},
+	})
+	s.stopTimeout = 10 * time.Millisecond
+
+	s.Apply(sections(t, "[slow]\nadapter = \"slow\"\nsetting = 1\n"))
+	nextEvents(t, events, 1)
+
+	// the old adapter is still running, so the new config isn't started
+	changed := sections(t, "[slow]\nadapter = \"slow\"\nsetting = 2\n")
+	result := s.Apply(changed)
+	if len(result.Started) > 0 || len(result.Restarted) > 0 || !slices.Equal(result.Stopped, []string{"slow"}) || !strings.Contains(result.Error, "slow") {
+		t.Errorf("unexpected reload %+v", result)
+	}
+	result = s.Apply(changed)
+	if len(result.Started) > 0 || !strings.Contains(result.Error, "slow") {
+		t.Errorf("unexpected reload %+v", result)
+	}
+	expectNoEvents(t, events)
+
+	// once it has stopped, the next reload starts the new config
+	old := s.stopping["slow"]
+	close(release)
+	<-old.done
+	result = s.Apply(changed)
+	expectReload(t, result, []string{"slow"}, []string{}, []string{})
+	if got := nextEvents(t, events, 1); got[0] != "start 2" {
+		t.Errorf("expected the new config to start, got %v", got)
+	}
+}
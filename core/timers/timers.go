@@ -1,26 +1,28 @@
 package timers
 
 import (
+	"context"
 	"time"
 
 	"github.com/yob/home-data/pubsub"
 )
 
-func Init(bus *pubsub.Pubsub) {
-	everyMinuteEvent(bus.PublishChannel())
+func Init(ctx context.Context, bus *pubsub.Pubsub) {
+	everyMinuteEvent(ctx, bus)
 }
 
-func everyMinuteEvent(publish chan pubsub.PubsubEvent) {
+func everyMinuteEvent(ctx context.Context, bus *pubsub.Pubsub) {
 	lastBroadcast := time.Now()
 
 	for {
 		if time.Now().After(lastBroadcast.Add(time.Second * 60)) {
-			publish <- pubsub.PubsubEvent{
-				Topic: "every:minute",
-				Data:  pubsub.NewValueEvent(time.Now().Format(time.RFC3339)),
-			}
+			bus.Publish("every:minute", pubsub.NewValueEvent(time.Now().Format(time.RFC3339)))
 			lastBroadcast = time.Now()
 		}
-		time.Sleep(1 * time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(1 * time.Second):
+		}
 	}
 }
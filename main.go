@@ -1,23 +1,38 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/yob/home-data/core/busmetrics"
 	"github.com/yob/home-data/core/config"
 	"github.com/yob/home-data/core/email"
+	"github.com/yob/home-data/core/filestate"
 	"github.com/yob/home-data/core/homestate"
+	"github.com/yob/home-data/core/journal"
 	"github.com/yob/home-data/core/logging"
 	"github.com/yob/home-data/core/memorystate"
+	"github.com/yob/home-data/core/sqlitestate"
 	"github.com/yob/home-data/core/statebus"
+	"github.com/yob/home-data/core/supervisor"
 	"github.com/yob/home-data/core/timers"
 
 	"github.com/yob/home-data/adapters/daikin"
 	"github.com/yob/home-data/adapters/datadog"
+	"github.com/yob/home-data/adapters/derived"
 	"github.com/yob/home-data/adapters/fronius"
 	"github.com/yob/home-data/adapters/kasa"
 	"github.com/yob/home-data/adapters/lifx"
+	"github.com/yob/home-data/adapters/mqtt"
 	"github.com/yob/home-data/adapters/reamped"
 	"github.com/yob/home-data/adapters/rules"
 	"github.com/yob/home-data/adapters/ruuvigateway"
@@ -25,22 +40,81 @@ import (
 	pub "github.com/yob/home-data/pubsub"
 )
 
+const (
+	// how long to wait for adapters to stop and the bus to drain before giving up
+	shutdownTimeout = 15 * time.Second
+)
+
+// When replaying a journal only these adapters are started. They make decisions based on
+// events, and everything else talks to the real world
+var replayAdapters = map[string]bool{
+	"derived": true,
+	"rules":   true,
+}
+
+// Every adapter that can be used in the config file, by the name used in adapter = "..."
+var adapters = map[string]adapter{
+	"daikin":       {daikin.Init, daikin.ConfigSchema},
+	"datadog":      {datadog.Init, datadog.ConfigSchema},
+	"derived":      {derived.Init, derived.ConfigSchema},
+	"kasa":         {kasa.Init, kasa.ConfigSchema},
+	"lifx":         {lifx.Init, lifx.ConfigSchema},
+	"mqtt":         {mqtt.Init, mqtt.ConfigSchema},
+	"fronius":      {fronius.Init, fronius.ConfigSchema},
+	"reamped":      {reamped.Init, reamped.ConfigSchema},
+	"rules":        {rules.Init, rules.ConfigSchema},
+	"ruuvigateway": {ruuvigateway.Init, ruuvigateway.ConfigSchema},
+	"unifi":        {unifi.Init, unifi.ConfigSchema},
+}
+
+type adapter struct {
+	init   supervisor.InitFunc
+	schema config.Schema
+}
+
+// The keys main reads from the core section. email and journal declare their own
+type stateData struct {
+	Backend string `config:"state_backend" default:"memory"`
+	Path    string `config:"state_path"`
+}
+
+// the defaults depend on the backend, so they're filled in before decoding
+type historyData struct {
+	Retention  time.Duration `config:"history_retention"`
+	MaxSamples int           `config:"history_max_samples"`
+}
+
+var coreSchema = append(config.SchemaFor(stateData{}), config.SchemaFor(historyData{})...)
+
 func main() {
-	adapterFuncs := map[string]func(*pub.Pubsub, *logging.Logger, homestate.StateReader, *config.ConfigSection){
-		"daikin":       daikin.Init,
-		"datadog":      datadog.Init,
-		"kasa":         kasa.Init,
-		"lifx":         lifx.Init,
-		"fronius":      fronius.Init,
-		"reamped":      reamped.Init,
-		"rules":        rules.Init,
-		"ruuvigateway": ruuvigateway.Init,
-		"unifi":        unifi.Init,
-	}
-	pubsub := pub.NewPubsub()
-	state := memorystate.New()
-
-	configPath, err := config.FindConfigPath()
+	replayPath := flag.String("replay", "", "replay events from a journal file or directory instead of talking to devices")
+	replaySpeed := flag.Float64("replay-speed", 1, "speed multiplier for -replay. 0 replays as fast as possible")
+	configFlag := flag.String("config", "", "path to the config file. Defaults to config.toml next to the binary, then /etc/home-data/config.toml")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [check-config]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	replaying := *replayPath != ""
+
+	switch flag.Arg(0) {
+	case "":
+	case "check-config":
+		os.Exit(checkConfig(*configFlag, flag.Args()[1:]))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// replaying as fast as possible would overrun the subscribers, so a replay slows down
+	// to their speed instead
+	busOpts := make([]pub.Option, 0)
+	if replaying {
+		busOpts = append(busOpts, pub.WithDefaultDropPolicy(pub.Block))
+	}
+	pubsub := pub.NewPubsub(busOpts...)
+
+	configPath, err := findConfigPath(*configFlag)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -50,14 +124,40 @@ func main() {
 		log.Fatal(fmt.Sprintf("error reading config file: %v", err))
 	}
 
+	// better to refuse to start than to run without an adapter that's misconfigured
+	if errs := validateConfig(configFile); len(errs) > 0 {
+		for _, err := range errs {
+			log.Print(err)
+		}
+		log.Fatal(fmt.Sprintf("%s is invalid, run '%s check-config' after fixing it", configPath, os.Args[0]))
+	}
+
 	coreConfig, err := configFile.Section("core")
 	if err != nil {
 		log.Fatal(fmt.Sprintf("Error reading core section from config file: %v", err))
 	}
 
+	state, err := newState(coreConfig, replaying, logging.NewLogger(pubsub.WithSource("state")))
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Error initializing state: %v", err))
+	}
+
+	// cancelled when systemd (or a human with ctrl-c) asks us to stop, and everything
+	// that isn't core should stop with it
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	// shuffle events between goroutines until the bus is shutdown
+	go pubsub.Run()
+
+	// goroutines that should be given a chance to finish before we exit
+	var running sync.WaitGroup
+
 	// all log messages printed via a single goroutine
+	loggingStopped := make(chan struct{})
 	go func() {
 		logging.Init(pubsub)
+		close(loggingStopped)
 	}()
 	err = pubsub.WaitUntilSubscriber("log:new", 5)
 	if err != nil {
@@ -65,52 +165,336 @@ func main() {
 	}
 
 	// update the shared state when attributes change
+	statebusStopped := make(chan struct{})
 	go func() {
-		logger := logging.NewLogger(pubsub)
-		statebus.Init(pubsub, logger, state)
+		bus := pubsub.WithSource("statebus")
+		statebus.Init(bus, logging.NewLogger(bus), state)
+		close(statebusStopped)
 	}()
 	err = pubsub.WaitUntilSubscriber("state:update", 5)
 	if err != nil {
 		log.Fatal(fmt.Sprintf("Error initializing statebus: %v", err))
 	}
 
-	// send emails
-	go func() {
-		logger := logging.NewLogger(pubsub)
-		email.Init(pubsub, logger, coreConfig)
-	}()
-	// TODO is it a fatal error if email is misconfigured?
-	// TODO should we block until the email subscriber is listening?
+	if replaying {
+		// nothing should leave the house during a replay, including emails
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			bus := pubsub.WithSource("journal")
+			journal.AcknowledgeControls(ctx, bus, logging.NewLogger(bus))
+		}()
+	} else {
+		// send emails
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			bus := pubsub.WithSource("email")
+			email.Init(ctx, bus, logging.NewLogger(bus), coreConfig)
+		}()
+		// email is optional. Init logs and returns if the smtp settings are missing, and
+		// everything else keeps running
+		// TODO should we block until the email subscriber is listening?
+
+		// trigger events at reliable intervals so anyone can listen to if they want to run code
+		// regularly
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			timers.Init(ctx, pubsub.WithSource("timers"))
+		}()
+	}
 
-	// trigger events at reliable intervals so anyone can listen to if they want to run code
-	// regularly
+	// record every event, so it can be replayed later. The journal runs until the bus is
+	// shutdown, so it's waited for after that rather than with the adapters
+	journalStopped := make(chan struct{})
+	if _, err := coreConfig.GetString("journal_path"); err == nil && !replaying {
+		go func() {
+			bus := pubsub.WithSource("journal")
+			journal.Init(bus, logging.NewLogger(bus), coreConfig)
+			close(journalStopped)
+		}()
+	} else {
+		close(journalStopped)
+	}
+
+	// put the bus counters into state, so they can be charted and alerted on
+	running.Add(1)
 	go func() {
-		timers.Init(pubsub)
+		defer running.Done()
+		busmetrics.Init(ctx, pubsub.WithSource("busmetrics"))
 	}()
 
-	// TEMP: debugging
+	// Now that core is all ready, load any adapters listed in the config file.
+	inits := make(map[string]supervisor.InitFunc)
+	for name, adapter := range adapters {
+		inits[name] = adapter.init
+	}
+	adapterSupervisor := supervisor.New(ctx, pubsub, state.ReadOnly(), inits)
+	adapterSupervisor.Apply(adapterSections(configFile, replaying))
+
+	// systemctl reload sends SIGHUP, which re-reads the config file and restarts only the
+	// adapters whose section changed
+	reloadSignal := make(chan os.Signal, 1)
+	signal.Notify(reloadSignal, syscall.SIGHUP)
 	go func() {
+		bus := pubsub.WithSource("config")
+		logger := logging.NewLogger(bus)
 		for {
-			length, capacity := pubsub.PublishChanStats()
-			fmt.Printf("publish - length: %d capacity: %d\n", length, capacity)
-			time.Sleep(10 * time.Second)
+			select {
+			case <-ctx.Done():
+				signal.Stop(reloadSignal)
+				return
+			case <-reloadSignal:
+			}
+			result := reloadConfig(logger, adapterSupervisor, configPath, coreConfig, replaying)
+			if err := pub.Publish(bus, "config:reloaded", result); err != nil {
+				logger.Error(fmt.Sprintf("config: %v", err))
+			}
 		}
 	}()
 
-	// Now that core is all ready, load any adapters listed in the config file.
-	for _, adapterSection := range configFile.AdapterSections() {
-		adapterName, _ := adapterSection.GetString("adapter")
-		localSection := adapterSection
-		logger := logging.NewLogger(pubsub)
-		if initFunc, ok := adapterFuncs[adapterName]; ok {
-			go func() {
-				initFunc(pubsub, logger, state.ReadOnly(), localSection)
-			}()
-		} else {
-			logger.Fatal(fmt.Sprintf("adapter '%s' not recognised", adapterName))
+	if replaying {
+		go func() {
+			bus := pubsub.WithSource("journal")
+			logger := logging.NewLogger(bus)
+			if err := journal.Replay(ctx, bus, logger, *replayPath, *replaySpeed, replayAdapters); err != nil && ctx.Err() == nil {
+				log.Fatal(fmt.Sprintf("Error replaying journal: %v", err))
+			}
+			// the replay is complete, so shutdown the same way we would for SIGTERM
+			stop()
+		}()
+	}
+
+	<-ctx.Done()
+	// a second signal will kill the process immediately
+	stop()
+	log.Print("shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// the adapters were told to stop when ctx was cancelled
+	stopped := make(chan struct{})
+	go func() {
+		running.Wait()
+		adapterSupervisor.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-shutdownCtx.Done():
+		log.Print("timed out waiting for adapters to stop")
+	}
+
+	// deliver anything the adapters published on their way out, then close every
+	// subscription so the core goroutines exit too
+	if err := pubsub.Shutdown(shutdownCtx); err != nil {
+		log.Print(fmt.Sprintf("error shutting down bus: %v", err))
+	}
+	select {
+	case <-statebusStopped:
+	case <-shutdownCtx.Done():
+	}
+	// the events written during shutdown, and closing the file
+	select {
+	case <-journalStopped:
+	case <-shutdownCtx.Done():
+	}
+
+	// save anything the state backend hasn't written yet
+	if closer, ok := state.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Print(fmt.Sprintf("error closing state: %v", err))
+		}
+	}
+
+	select {
+	case <-loggingStopped:
+	case <-shutdownCtx.Done():
+	}
+}
+
+// The config file named with --config, or the first one config.FindConfigPath finds
+func findConfigPath(configFlag string) (string, error) {
+	if configFlag == "" {
+		return config.FindConfigPath()
+	}
+	if _, err := os.Stat(configFlag); err != nil {
+		return "", fmt.Errorf("Unable to read config file: %v", err)
+	}
+	return configFlag, nil
+}
+
+// checkConfig validates the config file without starting anything, and returns the exit
+// status for the check-config command. flag.Parse stops at check-config, so --config can
+// come before or after it
+func checkConfig(configFlag string, args []string) int {
+	flags := flag.NewFlagSet("check-config", flag.ExitOnError)
+	flags.StringVar(&configFlag, "config", configFlag, "path to the config file")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [flags] check-config [--config path]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+
+	configPath, err := findConfigPath(configFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// errors reading the files name the file they're in
+	configFile, err := config.NewConfigFromFile(configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// so do validation errors
+	errs := validateConfig(configFile)
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	for _, path := range configFile.Paths() {
+		fmt.Printf("%s: ok\n", path)
+	}
+	return 0
+}
+
+// The sections to start an adapter for. When replaying a journal, that's only the adapters
+// in replayAdapters
+func adapterSections(configFile *config.ConfigFile, replaying bool) []*config.ConfigSection {
+	sections := make([]*config.ConfigSection, 0)
+	for _, section := range configFile.AdapterSections() {
+		adapterName, _ := section.GetString("adapter")
+		if replaying && !replayAdapters[adapterName] {
+			continue
+		}
+		sections = append(sections, section)
+	}
+	return sections
+}
+
+// reloadConfig reads the config file again and applies any changes to the adapter sections.
+// If the new file has a problem, it's logged and the adapters keep running with the config
+// they have. The core section is only read at startup, so changes to it need a restart
+func reloadConfig(logger *logging.Logger, adapterSupervisor *supervisor.Supervisor, configPath string, coreConfig *config.ConfigSection, replaying bool) supervisor.Reload {
+	logger.Debug(fmt.Sprintf("config: reloading %s", configPath))
+
+	configFile, err := config.NewConfigFromFile(configPath)
+	if err != nil {
+		logger.Error(fmt.Sprintf("config: not reloaded, error reading %s - %v", configPath, err))
+		return supervisor.Reload{Error: err.Error()}
+	}
+	if errs := validateConfig(configFile); len(errs) > 0 {
+		for _, err := range errs {
+			logger.Error(fmt.Sprintf("config: %v", err))
+		}
+		logger.Error(fmt.Sprintf("config: not reloaded, %s is invalid", configPath))
+		return supervisor.Reload{Error: errors.Join(errs...).Error()}
+	}
+
+	if newCore, err := configFile.Section("core"); err == nil && !newCore.Equal(coreConfig) {
+		logger.Error("config: the core section has changed, restart home-data to use it")
+	}
+
+	result := adapterSupervisor.Apply(adapterSections(configFile, replaying))
+	logger.Debug(fmt.Sprintf("config: reloaded - started %v, stopped %v, restarted %v", result.Started, result.Stopped, result.Restarted))
+	if result.Error != "" {
+		logger.Error(fmt.Sprintf("config: %s", result.Error))
+	}
+	return result
+}
+
+func validateConfig(configFile *config.ConfigFile) []error {
+	schemas := make(map[string]config.Schema)
+	for name, adapter := range adapters {
+		schemas[name] = adapter.schema
+	}
+
+	core := make(config.Schema, 0)
+	core = append(core, coreSchema...)
+	core = append(core, email.ConfigSchema...)
+	core = append(core, journal.ConfigSchema...)
+
+	errs := configFile.Validate(core, schemas)
+	if coreConfig, err := configFile.Section("core"); err == nil {
+		if err := email.ValidateConfig(coreConfig); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// The state backend is chosen with state_backend in the core config section. "memory"
+// is the default, "file" saves the state to state_path so it survives a restart, and
+// "sqlite" keeps it in a database at state_path that can be queried while debugging.
+//
+// A replay always uses memory, it shouldn't change the state of the real system. Backends
+// that write in the background report their errors to logger
+func newState(coreConfig *config.ConfigSection, replaying bool, logger *logging.Logger) (homestate.State, error) {
+	var stateConfig stateData
+	if err := coreConfig.Decode(&stateConfig); err != nil {
+		return nil, err
+	}
+	if replaying {
+		stateConfig.Backend = "memory"
+	}
+
+	history, err := historyConfig(coreConfig, stateConfig.Backend)
+	if err != nil {
+		return nil, err
+	}
+
+	onError := func(err error) {
+		logger.Error(err.Error())
+	}
+
+	switch stateConfig.Backend {
+	case "memory", "file":
+		opts := []memorystate.Option{memorystate.WithHistory(history.Retention, history.MaxSamples)}
+		if stateConfig.Backend == "memory" {
+			return memorystate.New(opts...), nil
+		}
+		if stateConfig.Path == "" {
+			return nil, fmt.Errorf("state_path must be set when state_backend is file")
 		}
+		return filestate.New(stateConfig.Path, onError, opts...)
+	case "sqlite":
+		if stateConfig.Path == "" {
+			return nil, fmt.Errorf("state_path must be set when state_backend is sqlite")
+		}
+		return sqlitestate.New(stateConfig.Path,
+			sqlitestate.WithHistory(history.Retention, history.MaxSamples),
+			sqlitestate.WithErrorHandler(onError),
+		)
+	default:
+		return nil, fmt.Errorf("state_backend '%s' not recognised", stateConfig.Backend)
 	}
+}
 
-	// loop forever, shuffling events between goroutines
-	pubsub.Run()
+// How much history to keep for each numeric state key. history_retention is a duration
+// like "2h", and history_max_samples limits the memory used by keys that update often.
+// Each backend has its own defaults, which are used for anything that isn't set
+func historyConfig(coreConfig *config.ConfigSection, backend string) (historyData, error) {
+	history := historyData{
+		Retention:  memorystate.DefaultHistoryRetention,
+		MaxSamples: memorystate.DefaultHistoryMaxSamples,
+	}
+	if backend == "sqlite" {
+		history.Retention = sqlitestate.DefaultHistoryRetention
+		history.MaxSamples = sqlitestate.DefaultHistoryMaxSamples
+	}
+	if err := coreConfig.Decode(&history); err != nil {
+		return historyData{}, err
+	}
+	return history, nil
 }
@@ -1,8 +1,12 @@
 package pubsub
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -13,26 +17,113 @@ const (
 
 	// ensure no single subscriber channel filling up can fill the publish channel
 	pubChannelBufferSize = channelBufferSize * 2
+
+	defaultBlockTimeout = 1 * time.Second
+)
+
+// DropPolicy controls what the bus does when a subscriber isn't keeping up and the
+// channel for its subscription is full
+type DropPolicy int
+
+const (
+	// discard the event being delivered. This is the default
+	DropNewest DropPolicy = iota
+
+	// discard the oldest event waiting in the channel to make room for the new one
+	DropOldest
+
+	// wait for the subscriber to make room, up to the subscription's block timeout, then
+	// discard the event being delivered. Note that every other subscriber waits too.
+	Block
+
+	// keep only the newest waiting event for each EventData.Key. If no waiting event
+	// shares a key with the new one, the oldest waiting event is discarded
+	CoalesceByKey
 )
 
+func (policy DropPolicy) String() string {
+	switch policy {
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	case Block:
+		return "block"
+	case CoalesceByKey:
+		return "coalesce-by-key"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(policy))
+	}
+}
+
+// Pubsub is a handle on the bus. Handles returned by WithSource share the same
+// subscriptions and publish channel, and only differ in the source they stamp on the
+// events they publish.
 type Pubsub struct {
-	mu              sync.RWMutex
-	subs            map[string][]*Subscription
-	publishChannel  chan PubsubEvent
-	closeSubChannel chan string
-	closed          bool
+	*broker
+	source string
+}
+
+type broker struct {
+	mu             sync.RWMutex
+	subs           map[string][]*Subscription
+	patternSubs    map[string][]*Subscription
+	publishChannel chan PubsubEvent
+	closed         bool
+	seq            uint64
+	stats          *busStats
+	defaultPolicy  DropPolicy
+
+	// closed by Shutdown to tell Run to stop, and by Run once it has
+	shutdownCh chan struct{}
+	stoppedCh  chan struct{}
 }
 
+// ErrClosed is returned when subscribing to a bus that has been shutdown
+var ErrClosed = errors.New("pubsub: bus is shutdown")
+
 type Subscription struct {
-	Topic   string
-	Ch      chan EventData
-	uuid    string
-	closeCh chan string
+	Topic        string
+	Ch           chan EventData
+	uuid         string
+	broker       *broker
+	stopCtxFunc  func() bool
+	closed       bool // protected by broker.mu
+	idx          int  // position in the slice for Topic, protected by broker.mu
+	policy       DropPolicy
+	blockTimeout time.Duration
+	dropped      atomic.Uint64
+}
+
+// SubscriptionOption can be passed to Subscribe to change the default behaviour of a
+// subscription
+type SubscriptionOption func(*Subscription)
+
+// WithDropPolicy sets what happens when the subscription channel is full
+func WithDropPolicy(policy DropPolicy) SubscriptionOption {
+	return func(sub *Subscription) {
+		sub.policy = policy
+	}
+}
+
+// WithBlockTimeout sets the policy to Block, waiting up to timeout for room in the
+// channel before discarding an event
+func WithBlockTimeout(timeout time.Duration) SubscriptionOption {
+	return func(sub *Subscription) {
+		sub.policy = Block
+		sub.blockTimeout = timeout
+	}
 }
 
 type PubsubEvent struct {
 	Topic string
 	Data  EventData
+
+	// The envelope fields are stamped by the bus. Seq is assigned by Run and increases by
+	// one for every event, so gaps or reordering are easy to spot
+	Seq         uint64
+	PublishedAt time.Time
+	Source      string
 }
 
 type HttpRequest struct {
@@ -52,12 +143,24 @@ type Email struct {
 }
 
 type EventData struct {
+	// Topic is set by the bus on delivery. It's the topic the event was published to,
+	// which is useful when the subscription was for a pattern like "daikin.*.control"
+	Topic string
+	// Seq, PublishedAt and Source are copied from the PubsubEvent envelope on delivery
+	Seq         uint64
+	PublishedAt time.Time
+	Source      string
+	// ReplyTo is set on events published with Request, and is the topic that Reply will
+	// publish a response to
+	ReplyTo      string
 	Type         string
 	Key          string
 	Value        string
 	HttpRequest  HttpRequest
 	HttpResponse HttpResponse
 	Email        Email
+	// Payload is only set on typed events, see Publish and Subscribe in typed.go
+	Payload any
 }
 
 func NewValueEvent(value string) EventData {
@@ -98,6 +201,7 @@ func NewHttpResponseEvent(status int, body string, uuid string) EventData {
 	}
 }
 
+// Deprecated: publish a pubsub.Email to email:send with Publish instead
 func NewEmailEvent(subject string, body string) EventData {
 	return EventData{
 		Type: "email",
@@ -108,80 +212,294 @@ func NewEmailEvent(subject string, body string) EventData {
 	}
 }
 
-func NewPubsub() *Pubsub {
-	ps := &Pubsub{}
-	ps.subs = make(map[string][]*Subscription)
-	ps.publishChannel = make(chan PubsubEvent, pubChannelBufferSize)
-	ps.closeSubChannel = make(chan string, channelBufferSize)
-
-	// All subscriptions we hand out include a Close() method that will signal
-	// back to us when the receiver isn't using it any more. The signal arrives on
-	// a shared channel for the entire bus, so when it arrives walk through the
-	// live subscriptions to find and remove it
-	//
-	// The current algorithm is super inefficient, but it works. I'll optimise it
-	// when the ineffeciency is a problem.
-	go func() {
-		for {
-			select {
-			case uuidToRemove := <-ps.closeSubChannel:
-				ps.mu.Lock()
-				for topic, subs := range ps.subs {
-					for idx, sub := range subs {
-						if sub.uuid == uuidToRemove {
-							// re-slice to remove the Subscription we don't need any more
-							ps.subs[topic][idx] = ps.subs[topic][len(ps.subs[topic])-1]
-							ps.subs[topic] = ps.subs[topic][:len(ps.subs[topic])-1]
-							continue
-						}
-					}
-
-					// this topic is totally unused now, so we don't need to keep it around
-					if len(ps.subs[topic]) == 0 {
-						delete(ps.subs, topic)
-					}
-				}
-				ps.mu.Unlock()
-			case <-time.After(100 * time.Millisecond):
-			}
+// A reply to an event published with Request. Use a nil error to indicate success
+func NewReplyEvent(err error) EventData {
+	if err != nil {
+		return EventData{
+			Type:  "reply",
+			Key:   "error",
+			Value: err.Error(),
 		}
-	}()
+	}
+	return EventData{
+		Type: "reply",
+		Key:  "ok",
+	}
+}
+
+// Option can be passed to NewPubsub to change the behaviour of the whole bus
+type Option func(*broker)
 
+// WithDefaultDropPolicy sets the policy used by subscriptions that don't choose one. A
+// journal replay uses Block, so replaying as fast as possible slows down to the speed of
+// the subscribers instead of dropping events
+func WithDefaultDropPolicy(policy DropPolicy) Option {
+	return func(b *broker) {
+		b.defaultPolicy = policy
+	}
+}
+
+func NewPubsub(opts ...Option) *Pubsub {
+	ps := &Pubsub{broker: &broker{}}
+	for _, opt := range opts {
+		opt(ps.broker)
+	}
+	ps.subs = make(map[string][]*Subscription)
+	ps.patternSubs = make(map[string][]*Subscription)
+	ps.publishChannel = make(chan PubsubEvent, pubChannelBufferSize)
+	ps.shutdownCh = make(chan struct{})
+	ps.stoppedCh = make(chan struct{})
+	ps.stats = newBusStats()
 	return ps
 }
 
-// Return a subscription struct that can be used to receive events. It's critical that
-// the subscription is closed when it's not needed any more. A typical pattern looks
-// like this:
+// the subscriptions for a topic, pattern or not. Callers must hold the write lock
+func (b *broker) topicSubs(topic string) map[string][]*Subscription {
+	if isPattern(topic) {
+		return b.patternSubs
+	}
+	return b.subs
+}
+
+func (b *broker) addSubscription(sub *Subscription) {
+	subs := b.topicSubs(sub.Topic)
+	sub.idx = len(subs[sub.Topic])
+	subs[sub.Topic] = append(subs[sub.Topic], sub)
+}
+
+// Each subscription knows where it is in the slice for its topic, so it can be removed
+// without searching. The last subscription is moved into the gap.
+func (b *broker) removeSubscription(sub *Subscription) {
+	subs := b.topicSubs(sub.Topic)
+	topicSubs := subs[sub.Topic]
+	last := len(topicSubs) - 1
+	if sub.idx > last || topicSubs[sub.idx] != sub {
+		return
+	}
+
+	topicSubs[sub.idx] = topicSubs[last]
+	topicSubs[sub.idx].idx = sub.idx
+	// clear the old slot so the backing array doesn't keep the subscription alive
+	topicSubs[last] = nil
+
+	// this topic is totally unused now, so we don't need to keep it around. Reply topics
+	// are only used once, and there are a lot of them
+	if last == 0 {
+		delete(subs, sub.Topic)
+	} else {
+		subs[sub.Topic] = topicSubs[:last]
+	}
+}
+
+// Return a subscription struct that can be used to receive events. The subscription is
+// detached from the bus and its channel closed when ctx is cancelled, when Close() is
+// called, or when the bus is shutdown. A typical pattern looks like this:
 //
-//	subEveryMinute, _ := bus.Subscribe("every:minute")
+//	subEveryMinute, _ := bus.Subscribe(ctx, "every:minute")
 //	defer subEveryMinute.Close()
 //	for event := range subEveryMinute.Ch {
 //	  // do things with event
 //	}
-func (ps *Pubsub) Subscribe(topic string) (*Subscription, error) {
-	ps.mu.Lock()
-	defer ps.mu.Unlock()
-
+//
+// Code that selects on the channel instead of ranging over it must check whether the
+// channel has been closed.
+//
+// The topic can also be a pattern. Topics are made of segments separated by "." or ":",
+// and in a pattern "*" matches exactly one segment while "#" matches everything that
+// follows it. For example:
+//
+//	daikin.*.control - matches daikin.kitchen.control and daikin.study.control
+//	state:#          - matches state:update and state:delete
+//	#                - matches every event on the bus
+//
+// The Topic field on each delivered EventData is the concrete topic that matched.
+//
+// By default, events are discarded when the subscription channel is full (unless the bus
+// was created with WithDefaultDropPolicy). Pass WithDropPolicy or WithBlockTimeout to
+// change that.
+//
+// If the bus has been shutdown, ErrClosed is returned along with a subscription that has
+// a closed channel.
+func (ps *Pubsub) Subscribe(ctx context.Context, topic string, opts ...SubscriptionOption) (*Subscription, error) {
 	subUUID, err := uuid.NewRandom()
 	if err != nil {
 		return nil, err
 	}
 
 	sub := &Subscription{
-		Topic:   topic,
-		Ch:      make(chan EventData, channelBufferSize),
-		uuid:    subUUID.String(),
-		closeCh: ps.closeSubChannel,
+		Topic:        topic,
+		Ch:           make(chan EventData, channelBufferSize),
+		uuid:         subUUID.String(),
+		broker:       ps.broker,
+		policy:       ps.defaultPolicy,
+		blockTimeout: defaultBlockTimeout,
 	}
-	ps.subs[topic] = append(ps.subs[topic], sub)
+	for _, opt := range opts {
+		opt(sub)
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.closed {
+		sub.closed = true
+		close(sub.Ch)
+		return sub, ErrClosed
+	}
+
+	ps.addSubscription(sub)
+	sub.stopCtxFunc = context.AfterFunc(ctx, sub.Close)
 	return sub, nil
 }
 
+// MatchTopic returns true if topic matches pattern, using the same rules as Subscribe. A
+// pattern with no wildcards only matches an identical topic.
+func MatchTopic(pattern string, topic string) bool {
+	for {
+		patternSegment, patternRest, patternSep := cutSegment(pattern)
+		if patternSegment == "#" {
+			return true
+		}
+		topicSegment, topicRest, topicSep := cutSegment(topic)
+		if patternSegment == "*" && topicSegment == "" {
+			return false
+		}
+		if patternSegment != "*" && patternSegment != topicSegment {
+			return false
+		}
+		if patternSep != topicSep {
+			return false
+		}
+		if patternSep == 0 {
+			return true
+		}
+		pattern, topic = patternRest, topicRest
+	}
+}
+
+func isPattern(topic string) bool {
+	return strings.ContainsAny(topic, "*#")
+}
+
+// split the first segment off a topic, returning the segment, the remainder and the
+// separator between them (or 0 if this was the last segment)
+func cutSegment(topic string) (string, string, byte) {
+	idx := strings.IndexAny(topic, ".:")
+	if idx < 0 {
+		return topic, "", 0
+	}
+	return topic[:idx], topic[idx+1:], topic[idx]
+}
+
+// all subscriptions that should receive an event published to topic. Callers must hold
+// at least a read lock
+func (ps *Pubsub) subscribersFor(topic string) []*Subscription {
+	subs := ps.subs[topic]
+	for pattern, patternSubs := range ps.patternSubs {
+		if MatchTopic(pattern, topic) {
+			// cap the slice first so we never append into the backing array of ps.subs
+			subs = append(subs[:len(subs):len(subs)], patternSubs...)
+		}
+	}
+	return subs
+}
+
+// Request publishes data to topic and waits for the subscriber to respond with Reply. It
+// returns an error if ctx expires before a reply arrives, or if the reply was created
+// with NewReplyEvent and a non-nil error.
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+//	defer cancel()
+//	_, err := bus.Request(ctx, "kasa.heater.control", pubsub.NewKeyValueEvent("power", "on"))
+func (ps *Pubsub) Request(ctx context.Context, topic string, data EventData) (EventData, error) {
+	correlationUUID, err := uuid.NewRandom()
+	if err != nil {
+		return EventData{}, err
+	}
+
+	// each request gets a private topic for the reply, so there's no risk of receiving a
+	// reply intended for someone else
+	data.ReplyTo = fmt.Sprintf("reply:%s", correlationUUID.String())
+	subReply, err := ps.Subscribe(ctx, data.ReplyTo)
+	if err != nil {
+		return EventData{}, err
+	}
+	defer subReply.Close()
+
+	select {
+	case ps.publishChannel <- ps.newEvent(topic, data):
+	case <-ctx.Done():
+		return EventData{}, fmt.Errorf("request to %s not published: %w", topic, ctx.Err())
+	case <-ps.shutdownCh:
+		return EventData{}, ErrClosed
+	}
+
+	select {
+	case reply, ok := <-subReply.Ch:
+		if !ok {
+			// the subscription was closed by ctx or by the bus shutting down
+			if ctx.Err() != nil {
+				return EventData{}, fmt.Errorf("no reply to request on %s: %w", topic, ctx.Err())
+			}
+			return EventData{}, ErrClosed
+		}
+		if reply.Type == "reply" && reply.Key == "error" {
+			return reply, errors.New(reply.Value)
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return EventData{}, fmt.Errorf("no reply to request on %s: %w", topic, ctx.Err())
+	}
+}
+
+// Reply responds to an event that was published with Request. If the event wasn't a
+// request then nobody is waiting for a reply, and this does nothing
+func (ps *Pubsub) Reply(request EventData, reply EventData) {
+	if request.ReplyTo == "" {
+		return
+	}
+	ps.Publish(request.ReplyTo, reply)
+}
+
+// WithSource returns a handle on the same bus that stamps source on every event it
+// publishes. Each adapter should be given its own handle so subscribers can tell where
+// events came from.
+func (ps *Pubsub) WithSource(source string) *Pubsub {
+	return &Pubsub{
+		broker: ps.broker,
+		source: source,
+	}
+}
+
+// Source returns the source stamped on events published with this handle
+func (ps *Pubsub) Source() string {
+	return ps.source
+}
+
+// Publish sends an event to every subscriber of topic. It may block if the bus is busy.
+// Once the bus has been shutdown, events are discarded.
+func (ps *Pubsub) Publish(topic string, data EventData) {
+	select {
+	case ps.publishChannel <- ps.newEvent(topic, data):
+	case <-ps.shutdownCh:
+	}
+}
+
+func (ps *Pubsub) newEvent(topic string, data EventData) PubsubEvent {
+	return PubsubEvent{
+		Topic:       topic,
+		Data:        data,
+		PublishedAt: time.Now(),
+		Source:      ps.source,
+	}
+}
+
 func (ps *Pubsub) PublishChanStats() (int, int) {
 	return len(ps.publishChannel), cap(ps.publishChannel)
 }
 
+// WaitUntilSubscriber waits until an event published to topic would be delivered to
+// someone, either a subscriber to the topic itself or to a pattern that matches it
 func (ps *Pubsub) WaitUntilSubscriber(topic string, timeoutInSecs int) error {
 	startedAt := time.Now()
 
@@ -189,62 +507,212 @@ func (ps *Pubsub) WaitUntilSubscriber(topic string, timeoutInSecs int) error {
 		if time.Now().After(startedAt.Add(time.Second * time.Duration(timeoutInSecs))) {
 			return fmt.Errorf("No subscribers on topic %s after %d seconds", topic, timeoutInSecs)
 		}
-		ps.mu.Lock()
-		if len(ps.subs[topic]) > 0 {
-			ps.mu.Unlock()
+		ps.mu.RLock()
+		subscribed := len(ps.subscribersFor(topic)) > 0
+		ps.mu.RUnlock()
+		if subscribed {
 			return nil
 		}
-		ps.mu.Unlock()
 
 		time.Sleep(100 * time.Millisecond)
 	}
 }
 
+// PublishChannel returns the channel that Publish sends on. Events sent directly on the
+// channel will have no Source, so Publish is preferred.
 func (ps *Pubsub) PublishChannel() chan PubsubEvent {
 	return ps.publishChannel
 }
 
+// Run loops until the bus is shutdown, delivering published events to subscribers
 func (ps *Pubsub) Run() {
+	defer close(ps.stoppedCh)
 
 	for {
 		select {
 		case event := <-ps.publishChannel:
-			if ps.closed {
-				continue
+			ps.seq++
+			event.Seq = ps.seq
+			if event.PublishedAt.IsZero() {
+				event.PublishedAt = time.Now()
 			}
+
 			ps.mu.RLock()
-			for _, sub := range ps.subs[event.Topic] {
+			data := event.Data
+			data.Topic = event.Topic
+			data.Seq = event.Seq
+			data.PublishedAt = event.PublishedAt
+			data.Source = event.Source
+			subs := ps.subscribersFor(event.Topic)
+			dropped := make([]bool, len(subs))
+			for idx, sub := range subs {
+				dropped[idx] = sub.deliver(data)
+			}
+			ps.stats.record(event.Topic, subs, dropped)
+			for idx, sub := range subs {
+				if !dropped[idx] || event.Topic == "log:new" {
+					// don't log about dropped log messages, that way lies a feedback loop
+					continue
+				}
+				message := fmt.Sprintf("Channel full. Discarded event (topic: %s sub: %s policy: %s dropped: %d ch-len: %d ch-cap: %d (%+v))", sub.Topic, sub.uuid, sub.policy, sub.Dropped(), len(sub.Ch), cap(sub.Ch), event.Data)
+				// Never block here, we're the only goroutine that drains the publish channel. If
+				// it's full the warning is lost, but that's better than a deadlocked bus
 				select {
-				case sub.Ch <- event.Data: // send event to the subscriber, unless it is full
+				case ps.publishChannel <- ps.newEvent("log:new", NewKeyValueEvent("ERROR", message)):
 				default:
-					message := fmt.Sprintf("Channel full. Discarding value (topic: %s sub: %s ch-len: %d ch-cap: %d (%+v))\n", sub.Topic, sub.uuid, len(sub.Ch), cap(sub.Ch), event.Data)
-					// TODO this should fail with a warning if the channel is full. Blocking here is BAD.
-					ps.publishChannel <- PubsubEvent{
-						Topic: "log:new",
-						Data:  NewKeyValueEvent("ERROR", message),
-					}
 				}
 			}
 			ps.mu.RUnlock()
-		case <-time.After(10 * time.Millisecond):
+		case <-ps.shutdownCh:
+			return
 		}
 	}
 }
 
-func (ps *Pubsub) Close() {
+// Shutdown waits for events that have already been published to be delivered, then stops
+// Run and closes every subscription. Subscribers ranging over their channel will exit
+// their loop, which is the signal for adapters to stop.
+//
+// If ctx expires before the publish channel is drained, the remaining events are
+// discarded and ctx.Err() is returned.
+func (ps *Pubsub) Shutdown(ctx context.Context) error {
+	var err error
+drain:
+	for len(ps.publishChannel) > 0 {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			break drain
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
 	ps.mu.Lock()
-	defer ps.mu.Unlock()
+	if ps.closed {
+		ps.mu.Unlock()
+		return err
+	}
+	ps.closed = true
+	close(ps.shutdownCh)
+	ps.mu.Unlock()
+
+	// Run might be part way through delivering an event, and it's not safe to close
+	// channels until it's finished
+	select {
+	case <-ps.stoppedCh:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
 
-	if !ps.closed {
-		ps.closed = true
-		for _, subs := range ps.subs {
-			for _, sub := range subs {
-				close(sub.Ch)
-			}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, subs := range ps.subs {
+		for _, sub := range subs {
+			sub.closed = true
+			close(sub.Ch)
+		}
+	}
+	for _, subs := range ps.patternSubs {
+		for _, sub := range subs {
+			sub.closed = true
+			close(sub.Ch)
 		}
 	}
+	ps.subs = make(map[string][]*Subscription)
+	ps.patternSubs = make(map[string][]*Subscription)
+	return err
 }
 
+// Close detaches the subscription from the bus and closes the channel. It's safe to call
+// more than once.
 func (s *Subscription) Close() {
-	s.closeCh <- s.uuid
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+
+	if s.stopCtxFunc != nil {
+		s.stopCtxFunc()
+	}
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.broker.removeSubscription(s)
+	close(s.Ch)
+}
+
+// Dropped returns the number of events that were discarded because the subscriber
+// wasn't keeping up
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// deliver sends data to the subscriber, applying the drop policy if the channel is full.
+// Returns true if an event was discarded.
+//
+// Run is the only goroutine that ever sends on a subscription channel, so once we've
+// taken events out of a full channel we know there's room to put events back.
+func (s *Subscription) deliver(data EventData) bool {
+	select {
+	case s.Ch <- data:
+		return false
+	default:
+	}
+
+	switch s.policy {
+	case DropOldest:
+		dropped := false
+		select {
+		case <-s.Ch:
+			dropped = true
+			s.dropped.Add(1)
+		default: // the subscriber made room in the meantime
+		}
+		s.Ch <- data
+		return dropped
+	case Block:
+		timer := time.NewTimer(s.blockTimeout)
+		defer timer.Stop()
+		select {
+		case s.Ch <- data:
+			return false
+		case <-timer.C:
+		}
+	case CoalesceByKey:
+		pending := make([]EventData, 0, cap(s.Ch)+1)
+	drain:
+		for {
+			select {
+			case waiting := <-s.Ch:
+				pending = append(pending, waiting)
+			default:
+				break drain
+			}
+		}
+
+		// keep only the newest event for each key, and if that still doesn't leave enough
+		// room then drop the oldest
+		pending = append(pending, data)
+		newest := make(map[string]int, len(pending))
+		for idx, waiting := range pending {
+			newest[waiting.Key] = idx
+		}
+		kept := pending[:0]
+		for idx, waiting := range pending {
+			if newest[waiting.Key] == idx {
+				kept = append(kept, waiting)
+			}
+		}
+		if len(kept) > cap(s.Ch) {
+			kept = kept[1:]
+		}
+		droppedCount := len(pending) - len(kept)
+		s.dropped.Add(uint64(droppedCount))
+		for _, waiting := range kept {
+			s.Ch <- waiting
+		}
+		return droppedCount > 0
+	}
+
+	s.dropped.Add(1)
+	return true
 }
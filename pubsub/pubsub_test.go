@@ -0,0 +1,143 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestWaitUntilSubscriberSeesPatterns(t *testing.T) {
+	ps := NewPubsub()
+
+	for _, pattern := range []string{"#", "daikin.*.control", "daikin.study.control"} {
+		sub, err := ps.Subscribe(context.Background(), pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ps.WaitUntilSubscriber("daikin.study.control", 1); err != nil {
+			t.Errorf("subscribed to %s: %v", pattern, err)
+		}
+		sub.Close()
+	}
+}
+
+func TestWaitUntilSubscriberTimesOut(t *testing.T) {
+	ps := NewPubsub()
+
+	sub, _ := ps.Subscribe(context.Background(), "daikin.*.control")
+	defer sub.Close()
+
+	if err := ps.WaitUntilSubscriber("kasa.heater.control", 0); err == nil {
+		t.Error("expected an error when nothing is subscribed")
+	}
+}
+
+func TestCloseRemovesSubscription(t *testing.T) {
+	ps := NewPubsub()
+
+	for _, topic := range []string{"daikin.study.control", "daikin.*.control"} {
+		first, _ := ps.Subscribe(context.Background(), topic)
+		second, _ := ps.Subscribe(context.Background(), topic)
+		subs := ps.topicSubs(topic)
+
+		first.Close()
+		if got := subs[topic]; len(got) != 1 || got[0] != second || second.idx != 0 {
+			t.Errorf("%s: expected only the second subscription to be left, got %v", topic, got)
+		}
+
+		second.Close()
+		if _, ok := subs[topic]; ok {
+			t.Errorf("%s: expected the topic to be removed once it has no subscriptions", topic)
+		}
+	}
+}
+
+func TestCloseRemovesFromTheMiddle(t *testing.T) {
+	ps := NewPubsub()
+
+	subs := make([]*Subscription, 5)
+	for idx := range subs {
+		subs[idx], _ = ps.Subscribe(context.Background(), "state:#")
+	}
+	subs[1].Close()
+	subs[3].Close()
+
+	remaining := ps.patternSubs["state:#"]
+	if len(remaining) != 3 {
+		t.Fatalf("expected 3 subscriptions, got %d", len(remaining))
+	}
+	for idx, sub := range remaining {
+		if sub.idx != idx {
+			t.Errorf("subscription at %d thinks it's at %d", idx, sub.idx)
+		}
+		if sub == subs[1] || sub == subs[3] {
+			t.Errorf("closed subscription still at %d", idx)
+		}
+	}
+}
+
+func TestSubscribeCloseDoesNotLeak(t *testing.T) {
+	ps := NewPubsub()
+	go ps.Run()
+	defer ps.Shutdown(context.Background())
+
+	// let the bus goroutine start before counting
+	time.Sleep(10 * time.Millisecond)
+	goroutines := runtime.NumGoroutine()
+
+	for i := 0; i < 10000; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		sub, err := ps.Subscribe(ctx, fmt.Sprintf("reply:%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pattern, _ := ps.Subscribe(ctx, fmt.Sprintf("reply:%d.*", i))
+		if i%2 == 0 {
+			sub.Close()
+			pattern.Close()
+		}
+		// the rest are closed by cancelling their context
+		cancel()
+	}
+
+	// context.AfterFunc runs Close in its own goroutine, give them a moment to finish
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		ps.mu.RLock()
+		empty := len(ps.subs) == 0 && len(ps.patternSubs) == 0
+		ps.mu.RUnlock()
+		if empty && runtime.NumGoroutine() <= goroutines {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	t.Errorf("expected no subscriptions, got %d topics and %d patterns. goroutines: %d before, %d after",
+		len(ps.subs), len(ps.patternSubs), goroutines, runtime.NumGoroutine())
+}
+
+func BenchmarkSubscribeClose(b *testing.B) {
+	ps := NewPubsub()
+	go ps.Run()
+	defer ps.Shutdown(context.Background())
+
+	// plenty of long lived subscriptions on the same topic, so removal has to be quick
+	// whatever position the subscription is in
+	for i := 0; i < 1000; i++ {
+		ps.Subscribe(context.Background(), "state:changed")
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sub, err := ps.Subscribe(context.Background(), "state:changed")
+		if err != nil {
+			b.Fatal(err)
+		}
+		sub.Close()
+	}
+}
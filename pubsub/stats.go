@@ -0,0 +1,112 @@
+package pubsub
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// every Request gets its own reply topic, so they're counted together to stop the stats
+// growing forever
+const replyStatsTopic = "reply"
+
+// TopicStats are the counters the bus keeps for each topic. Counts are totals since the
+// bus was created.
+type TopicStats struct {
+	Topic string
+
+	// events published to the topic
+	Published uint64
+
+	// events handed to a subscriber, and events discarded because a subscriber wasn't
+	// keeping up. An event with three subscribers counts three times
+	Delivered uint64
+	Dropped   uint64
+
+	// subscriptions that currently match the topic, including patterns
+	Subscribers int
+
+	// the most events ever waiting in a single subscription channel for this topic. When
+	// it gets close to the channel capacity, a subscriber is struggling
+	MaxChannelFill int
+}
+
+type busStats struct {
+	mu     sync.Mutex
+	topics map[string]*TopicStats
+}
+
+func newBusStats() *busStats {
+	return &busStats{topics: make(map[string]*TopicStats)}
+}
+
+// only called by Run
+func (s *busStats) record(topic string, subs []*Subscription, dropped []bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	topic = statsTopic(topic)
+	stats, ok := s.topics[topic]
+	if !ok {
+		stats = &TopicStats{Topic: topic}
+		s.topics[topic] = stats
+	}
+	stats.Published++
+	for idx, sub := range subs {
+		if dropped[idx] {
+			stats.Dropped++
+		} else {
+			stats.Delivered++
+		}
+		if fill := len(sub.Ch); fill > stats.MaxChannelFill {
+			stats.MaxChannelFill = fill
+		}
+	}
+}
+
+// Stats returns a snapshot of the counters for every topic that has been published to or
+// has a subscriber, sorted by topic. Pattern subscriptions are counted against each topic
+// they match, rather than listed separately. Replies to requests are all counted under a
+// single "reply" topic.
+func (ps *Pubsub) Stats() []TopicStats {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	ps.stats.mu.Lock()
+	defer ps.stats.mu.Unlock()
+
+	byTopic := make(map[string]TopicStats, len(ps.stats.topics))
+	for topic, stats := range ps.stats.topics {
+		byTopic[topic] = *stats
+	}
+	replySubscribers := 0
+	for topic, subs := range ps.subs {
+		if statsTopic(topic) == replyStatsTopic {
+			replySubscribers += len(subs)
+			topic = replyStatsTopic
+		}
+		if _, ok := byTopic[topic]; !ok {
+			byTopic[topic] = TopicStats{Topic: topic}
+		}
+	}
+
+	result := make([]TopicStats, 0, len(byTopic))
+	for topic, stats := range byTopic {
+		if topic == replyStatsTopic {
+			stats.Subscribers = replySubscribers
+		} else {
+			stats.Subscribers = len(ps.subscribersFor(topic))
+		}
+		result = append(result, stats)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Topic < result[j].Topic
+	})
+	return result
+}
+
+func statsTopic(topic string) string {
+	if strings.HasPrefix(topic, "reply:") {
+		return replyStatsTopic
+	}
+	return topic
+}
@@ -0,0 +1,181 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Typed events carry a single Go value in EventData.Payload instead of the string fields.
+// Each topic can only carry one type, which is bound the first time the topic is
+// registered, published to or subscribed to with the functions in this file.
+//
+// The registry is shared by every bus. Topics are a program-wide contract, and the journal
+// needs to know the type of a payload when it's replaying.
+var (
+	topicTypesMu sync.RWMutex
+	topicTypes   = make(map[string]reflect.Type)
+)
+
+// PayloadTypeError is returned when publishing or subscribing to a topic with a different
+// type to the one it's bound to
+type PayloadTypeError struct {
+	Topic string
+	Want  reflect.Type
+	Got   reflect.Type
+}
+
+func (e *PayloadTypeError) Error() string {
+	return fmt.Sprintf("pubsub: topic %s carries %s, not %s", e.Topic, e.Want, e.Got)
+}
+
+// Event is a typed event delivered by a TypedSubscription, along with the envelope it was
+// published in
+type Event[T any] struct {
+	Topic       string
+	Seq         uint64
+	PublishedAt time.Time
+	Source      string
+	ReplyTo     string
+	Payload     T
+}
+
+type TypedSubscription[T any] struct {
+	Topic     string
+	Ch        chan Event[T]
+	sub       *Subscription
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// RegisterTopic binds topic to T. It's optional, but packages that own a topic should
+// register it in an init() so that a replayed journal can decode the payloads
+func RegisterTopic[T any](topic string) error {
+	return bindTopicType(topic, reflect.TypeFor[T]())
+}
+
+// PayloadType returns the type that topic is bound to, if any
+func PayloadType(topic string) (reflect.Type, bool) {
+	topicTypesMu.RLock()
+	defer topicTypesMu.RUnlock()
+
+	payloadType, ok := topicTypes[topic]
+	return payloadType, ok
+}
+
+// Publish sends payload to every subscriber of topic. A PayloadTypeError is returned and
+// nothing is published if topic is bound to a different type.
+func Publish[T any](ps *Pubsub, topic string, payload T) error {
+	if err := bindTopicType(topic, reflect.TypeFor[T]()); err != nil {
+		return err
+	}
+	ps.Publish(topic, NewTypedEvent(payload))
+	return nil
+}
+
+// Request publishes payload to topic like Publish, then waits for a reply like
+// Pubsub.Request
+func Request[T any](ctx context.Context, ps *Pubsub, topic string, payload T) (EventData, error) {
+	if err := bindTopicType(topic, reflect.TypeFor[T]()); err != nil {
+		return EventData{}, err
+	}
+	return ps.Request(ctx, topic, NewTypedEvent(payload))
+}
+
+// Subscribe returns a subscription that receives payloads of type T. It behaves like
+// Pubsub.Subscribe, including support for patterns. When subscribing to a pattern, events
+// that don't carry a T (including untyped events) are skipped.
+func Subscribe[T any](ctx context.Context, ps *Pubsub, topic string, opts ...SubscriptionOption) (*TypedSubscription[T], error) {
+	if !isPattern(topic) {
+		if err := bindTopicType(topic, reflect.TypeFor[T]()); err != nil {
+			return nil, err
+		}
+	}
+
+	sub, err := ps.Subscribe(ctx, topic, opts...)
+	if sub == nil {
+		return nil, err
+	}
+	typedSub := &TypedSubscription[T]{
+		Topic: topic,
+		Ch:    make(chan Event[T]),
+		sub:   sub,
+		done:  make(chan struct{}),
+	}
+
+	// the underlying subscription is buffered and applies the drop policy, so this
+	// channel doesn't need to be
+	go func() {
+		defer close(typedSub.Ch)
+		for event := range sub.Ch {
+			payload, ok := event.Payload.(T)
+			if !ok {
+				continue
+			}
+			select {
+			case typedSub.Ch <- Event[T]{
+				Topic:       event.Topic,
+				Seq:         event.Seq,
+				PublishedAt: event.PublishedAt,
+				Source:      event.Source,
+				ReplyTo:     event.ReplyTo,
+				Payload:     payload,
+			}:
+			case <-typedSub.done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return typedSub, err
+}
+
+// Close detaches the subscription from the bus and closes the channel. It's safe to call
+// more than once.
+func (s *TypedSubscription[T]) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	s.sub.Close()
+}
+
+// Dropped returns the number of events that were discarded because the subscriber
+// wasn't keeping up
+func (s *TypedSubscription[T]) Dropped() uint64 {
+	return s.sub.Dropped()
+}
+
+// KeyedPayload can be implemented by payloads that have a natural key, like the name of
+// a state key. The key is copied to EventData.Key so CoalesceByKey works on typed events.
+type KeyedPayload interface {
+	PayloadKey() string
+}
+
+func NewTypedEvent(payload any) EventData {
+	data := EventData{
+		Type:    "typed",
+		Payload: payload,
+	}
+	if keyed, ok := payload.(KeyedPayload); ok {
+		data.Key = keyed.PayloadKey()
+	}
+	return data
+}
+
+func bindTopicType(topic string, payloadType reflect.Type) error {
+	topicTypesMu.Lock()
+	defer topicTypesMu.Unlock()
+
+	if existing, ok := topicTypes[topic]; ok {
+		if existing != payloadType {
+			return &PayloadTypeError{Topic: topic, Want: existing, Got: payloadType}
+		}
+		return nil
+	}
+	topicTypes[topic] = payloadType
+	return nil
+}